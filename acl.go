@@ -0,0 +1,290 @@
+package s3browser
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Permissions granted by ACL rules
+const (
+	permList     = "list"     // see the entry in listings, feeds, etc. and list a directory
+	permDownload = "download" // get a file, its preview, thumbnail or checksum
+	permUpload   = "upload"   // create files and folders
+	permDelete   = "delete"   // delete, or rename (which also needs upload on the new path)
+)
+
+// defaultGroupClaim is the user metadata holding the groups, i.e. `{http.auth.user.groups}`.
+const defaultGroupClaim = "groups"
+
+// ACLRule grants or denies permissions on the paths matching `Path`.
+// Rules are checked in order, the first matching rule mentioning a permission decides.
+// Without a matching rule, everything is allowed.
+type ACLRule struct {
+	// Glob of the paths the rule applies to, `*` matches within a path
+	// element and `**` any number of elements, e.g. `/private/**`.
+	Path  string   `json:"path"`
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+
+	// Who the rule applies to, anyone matching one of them.
+	// The rule applies to everyone when all are empty.
+	Users  []string `json:"users,omitempty"`  // users authenticated by Caddy, `*` for any
+	Groups []string `json:"groups,omitempty"` // groups from the group claim of the user
+	IPs    []string `json:"ips,omitempty"`    // client IPs or CIDRs
+}
+
+// accessControl evaluates the ACL rules.
+type accessControl struct {
+	rules      []ACLRule
+	nets       [][]*net.IPNet // parsed IPs of each rule
+	groupClaim string
+}
+
+// subject is who makes a request.
+type subject struct {
+	user   string
+	groups []string
+	ip     net.IP
+	shared *shareToken // share link used by the request
+}
+
+type subjectCtxKey struct{}
+
+func newAccessControl(rules []ACLRule, groupClaim string) (*accessControl, error) {
+	if groupClaim == "" {
+		groupClaim = defaultGroupClaim
+	}
+	ac := &accessControl{rules: rules, groupClaim: groupClaim}
+
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return nil, fmt.Errorf("acl path must start with /: %q", rule.Path)
+		}
+		if _, err := path.Match(rule.Path, ""); err != nil {
+			return nil, fmt.Errorf("invalid acl path %q: %v", rule.Path, err)
+		}
+		for _, perm := range append(append([]string{}, rule.Allow...), rule.Deny...) {
+			switch perm {
+			case permList, permDownload, permUpload, permDelete:
+			default:
+				return nil, fmt.Errorf("unknown acl permission: %q", perm)
+			}
+		}
+
+		nets := []*net.IPNet{}
+		for _, val := range rule.IPs {
+			if !strings.Contains(val, "/") {
+				if strings.Contains(val, ":") {
+					val += "/128"
+				} else {
+					val += "/32"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid acl ip: %v", err)
+			}
+			nets = append(nets, ipNet)
+		}
+		ac.nets = append(ac.nets, nets)
+	}
+	return ac, nil
+}
+
+// subject returns who makes the request `r`.
+func (ac *accessControl) subject(r *http.Request) subject {
+	if s, ok := r.Context().Value(subjectCtxKey{}).(subject); ok {
+		return s
+	}
+
+	s := subject{user: requestUser(r), shared: shareGrant(r)}
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		claim, _ := repl.Get("http.auth.user." + ac.groupClaim)
+		switch groups := claim.(type) {
+		case []string:
+			s.groups = groups
+		case string:
+			s.groups = strings.FieldsFunc(groups, func(c rune) bool { return c == ',' || c == ' ' })
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	s.ip = net.ParseIP(host)
+	return s
+}
+
+// withSubject stores the subject in the request context, so it is only computed once.
+func (ac *accessControl) withSubject(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), subjectCtxKey{}, ac.subject(r)))
+}
+
+func (ac *accessControl) applies(i int, s subject) bool {
+	rule := ac.rules[i]
+	if len(rule.Users) == 0 && len(rule.Groups) == 0 && len(rule.IPs) == 0 {
+		return true
+	}
+	for _, user := range rule.Users {
+		if s.user != "" && (user == "*" || user == s.user) {
+			return true
+		}
+	}
+	for _, group := range rule.Groups {
+		for _, g := range s.groups {
+			if g == group {
+				return true
+			}
+		}
+	}
+	for _, ipNet := range ac.nets[i] {
+		if s.ip != nil && ipNet.Contains(s.ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed checks if `s` has the permission `perm` on `p`.
+func (ac *accessControl) allowed(s subject, perm string, p string) bool {
+	if ac == nil {
+		return true
+	}
+	p = normalizePath(p)
+	// Share links give access whatever the rules
+	if s.shared != nil && (perm == permList || perm == permDownload) && s.shared.covers(p) {
+		return true
+	}
+	for i, rule := range ac.rules {
+		if !matchGlob(rule.Path, p) || !ac.applies(i, s) {
+			continue
+		}
+		for _, deny := range rule.Deny {
+			if deny == perm {
+				return false
+			}
+		}
+		for _, allow := range rule.Allow {
+			if allow == perm {
+				return true
+			}
+		}
+	}
+	return true
+}
+
+// allowed checks if the requester has the permission `perm` on `p`.
+func (b *S3Browser) allowed(r *http.Request, perm string, p string) bool {
+	if b.acl == nil {
+		return true
+	}
+	return b.acl.allowed(b.acl.subject(r), perm, p)
+}
+
+// denied returns the error for a request lacking a permission on `p`.
+// Paths the requester can't list don't exist for them.
+func (b *S3Browser) denied(r *http.Request, p string) error {
+	if !b.allowed(r, permList, p) {
+		return caddyhttp.Error(http.StatusNotFound, nil)
+	}
+	return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("access denied: %s", p))
+}
+
+// filterDir removes the entries of `dir` the requester can't list.
+func (b *S3Browser) filterDir(r *http.Request, dir Directory) Directory {
+	if b.acl == nil {
+		return dir
+	}
+	return b.acl.filterDir(b.acl.subject(r), dir)
+}
+
+func (ac *accessControl) filterDir(s subject, dir Directory) Directory {
+	if ac == nil {
+		return dir
+	}
+	out := dir
+	out.Folders = []string{}
+	for _, name := range dir.Folders {
+		if ac.allowed(s, permList, path.Join(dir.Path, name)) {
+			out.Folders = append(out.Folders, name)
+		}
+	}
+	out.Filenames = []string{}
+	out.files = map[string]File{}
+	for _, name := range dir.Filenames {
+		if ac.allowed(s, permList, path.Join(dir.Path, name)) {
+			out.Filenames = append(out.Filenames, name)
+			out.files[name] = dir.files[name]
+		}
+	}
+	return out
+}
+
+// matchGlob reports whether the path `p` matches `pattern`.
+// Like path.Match, with `**` matching any number of path elements.
+func matchGlob(pattern, p string) bool {
+	return matchElems(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(strings.Trim(p, "/"), "/"))
+}
+
+func matchElems(pattern, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(elems); i++ {
+				if matchElems(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
+
+// parseACLRule parses an `acl <path> { ... }` block.
+func parseACLRule(d *caddyfile.Dispenser) (ACLRule, error) {
+	rule := ACLRule{}
+	if !d.Args(&rule.Path) {
+		return rule, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var values []string
+		switch d.Val() {
+		case "allow":
+			values = d.RemainingArgs()
+			rule.Allow = append(rule.Allow, values...)
+		case "deny":
+			values = d.RemainingArgs()
+			rule.Deny = append(rule.Deny, values...)
+		case "user":
+			values = d.RemainingArgs()
+			rule.Users = append(rule.Users, values...)
+		case "group":
+			values = d.RemainingArgs()
+			rule.Groups = append(rule.Groups, values...)
+		case "ip":
+			values = d.RemainingArgs()
+			rule.IPs = append(rule.IPs, values...)
+		default:
+			return rule, d.Errf("not a valid acl option")
+		}
+		if len(values) == 0 {
+			return rule, d.ArgErr()
+		}
+	}
+	return rule, nil
+}
@@ -0,0 +1,130 @@
+package s3browser
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"/docs", "/docs", true},
+		{"/docs", "/docs/", true},
+		{"/docs/", "/docs", true},
+		{"/docs", "/docs/a.txt", false},
+		{"/docs", "/doc", false},
+		{"/docs", "/docsx", false},
+		{"/docs/*", "/docs/a.txt", true},
+		{"/docs/*", "/docs/api/v1.json", false},
+		{"/docs/*.txt", "/docs/a.txt", true},
+		{"/docs/*.txt", "/docs/a.json", false},
+		{"/docs/**", "/docs", true},
+		{"/docs/**", "/docs/a.txt", true},
+		{"/docs/**", "/docs/api/v1.json", true},
+		{"/docs/**", "/docsx/a.txt", false},
+		{"/**", "/", true},
+		{"/**", "/a/b/c", true},
+		{"/**/*.pdf", "/a.pdf", true},
+		{"/**/*.pdf", "/a/b/c.pdf", true},
+		{"/**/*.pdf", "/a/b/c.txt", false},
+		{"/a/**/z", "/a/z", true},
+		{"/a/**/z", "/a/b/c/z", true},
+		{"/a/**/z", "/a/b/c/z/d", false},
+		{"/a/**/z/", "/a/b/z", true},
+		{"/?", "/a", true},
+		{"/?", "/ab", false},
+		{"/[ab]", "/b", true},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestACLAllowed(t *testing.T) {
+	ac, err := newAccessControl([]ACLRule{
+		// The first rule mentioning a permission decides
+		{Path: "/public/**", Allow: []string{permList, permDownload}},
+		{Path: "/team/**", Allow: []string{permUpload, permDelete}, Groups: []string{"team"}},
+		{Path: "/team/**", Allow: []string{permList, permDownload}, Users: []string{"*"}},
+		{Path: "/office/**", Allow: []string{permList, permDownload}, IPs: []string{"10.0.0.0/8", "192.0.2.7"}},
+		{Path: "/**/*.secret", Deny: []string{permDownload}, Users: []string{"alice"}},
+		{Path: "/**", Allow: []string{permList}, Users: []string{"admin"}},
+		{Path: "/**", Deny: []string{permList, permDownload, permUpload, permDelete}},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	anonymous := subject{ip: net.ParseIP("203.0.113.1")}
+	alice := subject{user: "alice", groups: []string{"team"}, ip: net.ParseIP("203.0.113.1")}
+	bob := subject{user: "bob", ip: net.ParseIP("203.0.113.1")}
+	admin := subject{user: "admin"}
+	office := subject{ip: net.ParseIP("10.1.2.3")}
+	officeHost := subject{ip: net.ParseIP("192.0.2.7")}
+	otherHost := subject{ip: net.ParseIP("192.0.2.8")}
+	shared := subject{shared: &shareToken{Path: "/private/report"}}
+
+	tests := []struct {
+		name string
+		s    subject
+		perm string
+		path string
+		want bool
+	}{
+		{"public", anonymous, permDownload, "/public/a.txt", true},
+		{"public root", anonymous, permList, "/public", true},
+		{"public upload", anonymous, permUpload, "/public/a.txt", false},
+		{"default deny", anonymous, permList, "/team/a.txt", false},
+		{"root", anonymous, permList, "/", false},
+		{"group", alice, permUpload, "/team/a.txt", true},
+		{"group and any user", alice, permDownload, "/team/a.txt", true},
+		{"any user", bob, permDownload, "/team/a.txt", true},
+		{"not in group", bob, permUpload, "/team/a.txt", false},
+		{"earlier allow wins", alice, permDownload, "/team/x.secret", true},
+		{"deny for user", alice, permDownload, "/private/x.secret", false},
+		{"deny not for other users", admin, permList, "/private/x.secret", true},
+		{"later deny", admin, permDownload, "/private/x.secret", false},
+		{"cidr", office, permDownload, "/office/a.txt", true},
+		{"single ip", officeHost, permDownload, "/office/a.txt", true},
+		{"other ip", otherHost, permDownload, "/office/a.txt", false},
+		{"share link", shared, permDownload, "/private/report", true},
+		{"share link below", shared, permList, "/private/report/2024.pdf", true},
+		{"share link prefix", shared, permDownload, "/private/report2", false},
+		{"share link upload", shared, permUpload, "/private/report", false},
+	}
+	for _, tt := range tests {
+		if got := ac.allowed(tt.s, tt.perm, tt.path); got != tt.want {
+			t.Errorf("%s: allowed(%s, %s) = %v, want %v", tt.name, tt.perm, tt.path, got, tt.want)
+		}
+	}
+
+	// Without rules, everything is allowed
+	var none *accessControl
+	if !none.allowed(anonymous, permDelete, "/a") {
+		t.Error("denied without rules")
+	}
+	// Nor without a matching rule
+	ac, _ = newAccessControl([]ACLRule{{Path: "/private/**", Deny: []string{permList}}}, "")
+	if !ac.allowed(anonymous, permList, "/public") || ac.allowed(anonymous, permList, "/private/a") {
+		t.Error("only the matching rules apply")
+	}
+}
+
+func TestNewAccessControlErrors(t *testing.T) {
+	for _, rule := range []ACLRule{
+		{Path: "docs/**"},
+		{Path: "/[docs"},
+		{Path: "/docs", Allow: []string{"read"}},
+		{Path: "/docs", IPs: []string{"10.0.0.0/33"}},
+		{Path: "/docs", IPs: []string{"localhost"}},
+	} {
+		if _, err := newAccessControl([]ACLRule{rule}, ""); err == nil {
+			t.Errorf("no error for %+v", rule)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package s3browser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Values for backend
+const (
+	backendS3     = "s3"
+	backendLocal  = "local"
+	backendMemory = "memory"
+)
+
+var errPresignUnsupported = errors.New("the backend can't presign URLs")
+
+// Backend stores the browsed files. The keys are the paths without the leading slash,
+// directories are implied by the keys, or marked by an empty object whose key ends with a slash.
+//
+// S3Client is the main implementation, LocalBackend serves a directory and MemoryBackend
+// keeps everything in memory. Other storages can be browsed through an adapter,
+// features such as management or versions still require S3.
+type Backend interface {
+	// ForEachObjectIn calls `fn` for every object whose key starts with `prefix`, in key order.
+	ForEachObjectIn(ctx context.Context, prefix string, fn func(minio.ObjectInfo)) error
+	StatObject(ctx context.Context, filePath string) (minio.ObjectInfo, error)
+	// GetObject reads the object, or the part of it selected by `rangeHdr` (a Range header value).
+	// The headers are those of an S3 response: Content-Length, Content-Type, ETag, Last-Modified and Content-Range.
+	GetObject(ctx context.Context, filePath string, rangeHdr string) (io.ReadCloser, minio.ObjectInfo, http.Header, error)
+	// PresignedGetObject returns a URL to download the object without credentials, or errPresignUnsupported.
+	PresignedGetObject(ctx context.Context, filePath string, expiry time.Duration, params url.Values) (*url.URL, error)
+	// PutObject stores `reader`, `size` may be -1 if unknown. It returns the info of the new object.
+	PutObject(ctx context.Context, filePath string, reader io.Reader, size int64, contentType string) (minio.ObjectInfo, error)
+}
+
+// Interface guards
+var (
+	_ Backend = (*S3Client)(nil)
+	_ Backend = (*LocalBackend)(nil)
+	_ Backend = (*MemoryBackend)(nil)
+)
+
+// newBackend returns the backend selected by `backend`.
+// A backend set before Provision is kept, so the plugin can be tested without a server.
+func (b *S3Browser) newBackend() (Backend, error) {
+	if b.store != nil {
+		return b.store, nil
+	}
+	switch b.Backend {
+	case "", backendS3:
+		c, err := NewS3Client(b.Endpoint, b.Key, b.Secret, b.Secure, b.Bucket, b.Region)
+		if err != nil {
+			return nil, err
+		}
+		c.sse = b.sse
+		c.SetHeader(b.s3Header)
+		return &c, nil
+	case backendLocal:
+		return NewLocalBackend(b.BackendRoot)
+	case backendMemory:
+		return NewMemoryBackend(), nil
+	default:
+		return nil, fmt.Errorf("unknown backend: %s", b.Backend)
+	}
+}
+
+// s3Client returns the backend when it is S3, nil otherwise.
+func (b *S3Browser) s3Client() *S3Client {
+	c, _ := b.store.(*S3Client)
+	return c
+}
+
+// objectRange is the part of an object selected by a Range header, like S3 only one range is supported.
+type objectRange struct {
+	start, length int64
+}
+
+// parseRange parses `rangeHdr` for an object of `size` bytes, an empty header selects the whole object.
+// Invalid headers are ignored like S3 does, unsatisfiable ranges are an error.
+func parseRange(rangeHdr string, size int64) (objectRange, bool, error) {
+	whole := objectRange{start: 0, length: size}
+	spec := strings.TrimPrefix(rangeHdr, "bytes=")
+	if rangeHdr == "" || spec == rangeHdr || strings.Contains(spec, ",") {
+		return whole, false, nil
+	}
+	bounds := strings.SplitN(spec, "-", 2)
+	if len(bounds) != 2 {
+		return whole, false, nil
+	}
+	first, last := bounds[0], bounds[1]
+
+	var r objectRange
+	if first == "" {
+		// Suffix: the last bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return whole, false, nil
+		}
+		if n > size {
+			n = size
+		}
+		r = objectRange{start: size - n, length: n}
+	} else {
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return whole, false, nil
+		}
+		end := size - 1
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+				return whole, false, nil
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+		r = objectRange{start: start, length: end - start + 1}
+	}
+	if r.start >= size || r.length <= 0 {
+		return r, true, minio.ErrorResponse{Code: "InvalidRange", Message: "The requested range is not satisfiable", StatusCode: http.StatusRequestedRangeNotSatisfiable}
+	}
+	return r, true, nil
+}
+
+// readObject returns the part of `content` selected by `rangeHdr`, with the headers S3 would send.
+func readObject(content io.ReadSeeker, info minio.ObjectInfo, rangeHdr string) (io.Reader, http.Header, error) {
+	r, partial, err := parseRange(rangeHdr, info.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := content.Seek(r.start, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	headers := http.Header{}
+	headers.Set("Content-Type", info.ContentType)
+	headers.Set("Content-Length", strconv.FormatInt(r.length, 10))
+	headers.Set("ETag", `"`+info.ETag+`"`)
+	headers.Set("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	if partial {
+		headers.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, info.Size))
+	}
+	return io.LimitReader(content, r.length), headers, nil
+}
+
+// noSuchKey is the error of a missing object, like S3's.
+func noSuchKey(key string) error {
+	return minio.ErrorResponse{Code: "NoSuchKey", Message: "The specified key does not exist.", Key: key, StatusCode: http.StatusNotFound}
+}
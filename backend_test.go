@@ -0,0 +1,54 @@
+package s3browser
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header  string
+		size    int64
+		want    objectRange
+		partial bool
+		err     bool
+	}{
+		{"", 10, objectRange{0, 10}, false, false},
+		{"bytes=0-4", 10, objectRange{0, 5}, true, false},
+		{"bytes=5-", 10, objectRange{5, 5}, true, false},
+		{"bytes=8-20", 10, objectRange{8, 2}, true, false},
+		// Suffix ranges
+		{"bytes=-3", 10, objectRange{7, 3}, true, false},
+		{"bytes=-20", 10, objectRange{0, 10}, true, false},
+		// Unsatisfiable
+		{"bytes=10-", 10, objectRange{}, true, true},
+		{"bytes=10-12", 10, objectRange{}, true, true},
+		{"bytes=-0", 10, objectRange{}, true, true},
+		{"bytes=0-", 0, objectRange{}, true, true},
+		// Ignored, the whole object is sent
+		{"bytes=0-1,4-5", 10, objectRange{0, 10}, false, false},
+		{"bytes=-1,-2", 10, objectRange{0, 10}, false, false},
+		{"items=0-4", 10, objectRange{0, 10}, false, false},
+		{"bytes=4-2", 10, objectRange{0, 10}, false, false},
+		{"bytes=a-b", 10, objectRange{0, 10}, false, false},
+		{"bytes=-", 10, objectRange{0, 10}, false, false},
+	}
+	for _, tt := range tests {
+		got, partial, err := parseRange(tt.header, tt.size)
+		if tt.err {
+			if minio.ToErrorResponse(err).StatusCode != http.StatusRequestedRangeNotSatisfiable {
+				t.Errorf("parseRange(%q, %d): got error %v, want InvalidRange", tt.header, tt.size, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRange(%q, %d): %v", tt.header, tt.size, err)
+			continue
+		}
+		if got != tt.want || partial != tt.partial {
+			t.Errorf("parseRange(%q, %d) = %+v, %v, want %+v, %v", tt.header, tt.size, got, partial, tt.want, tt.partial)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
 )
 
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
@@ -36,9 +37,35 @@ func parseDurationArg(d *caddyfile.Dispenser, out *time.Duration) error {
 	return err
 }
 
+func parseIntArg(d *caddyfile.Dispenser, out *int) error {
+	var strVal string
+	err := parseStringArg(d, &strVal)
+	if err == nil {
+		*out, err = strconv.Atoi(strVal)
+	}
+	return err
+}
+
+func parseSizeArg(d *caddyfile.Dispenser, out *int64) error {
+	var strVal string
+	err := parseStringArg(d, &strVal)
+	if err == nil {
+		var size uint64
+		size, err = humanize.ParseBytes(strVal)
+		*out = int64(size)
+	}
+	return err
+}
+
 func parseStringArg(d *caddyfile.Dispenser, out *string) error {
 	if !d.Args(out) {
 		return d.ArgErr()
 	}
 	return nil
 }
+
+// parseStringsArg accepts any number of arguments, none clears the list.
+func parseStringsArg(d *caddyfile.Dispenser, out *[]string) error {
+	*out = d.RemainingArgs()
+	return nil
+}
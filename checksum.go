@@ -0,0 +1,231 @@
+package s3browser
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Supported checksum algorithms, also the extension of the virtual checksum files
+const (
+	algoMD5    = "md5"
+	algoSHA256 = "sha256"
+)
+
+// sumsFileName is the virtual file listing the SHA256 of every file of a directory
+const sumsFileName = "SHA256SUMS"
+
+// maxChecksumEntries bounds the number of checksums kept in memory.
+const maxChecksumEntries = 100000
+
+// Bounds of the checksums a SHA256SUMS request computes, the others are computed by the next requests
+const (
+	maxSumsFiles      = 100
+	maxSumsBytes      = 1 << 30 // 1 GiB
+	sumsRetryInterval = 10 * time.Second
+)
+
+var errSumsIncomplete = errors.New("too many checksums to compute at once")
+
+// md5ETagRegex matches ETags that are the MD5 of the object.
+// Multipart uploads have a "-<parts>" suffix and are not.
+var md5ETagRegex = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// storedChecksums is implemented by the backends keeping a checksum of the objects, see S3Client.StoredSHA256.
+type storedChecksums interface {
+	StoredSHA256(ctx context.Context, filePath string) (string, error)
+}
+
+// ChecksumCache computes the checksums of objects and keeps them by ETag.
+type ChecksumCache struct {
+	lock    sync.Mutex
+	backend Backend
+	sse     *serverSideEncryption
+	logger  *zap.Logger
+	entries map[string]string // "<algo>:<etag>" -> hex digest
+}
+
+type Checksums struct {
+	MD5    string `json:"md5,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func NewChecksumCache(backend Backend, sse *serverSideEncryption, l *zap.Logger) *ChecksumCache {
+	return &ChecksumCache{
+		backend: backend,
+		sse:     sse,
+		logger:  l,
+		entries: map[string]string{},
+	}
+}
+
+// Cached returns the checksums known without reading the object.
+func (cc *ChecksumCache) Cached(filePath string, file File) Checksums {
+	sums := Checksums{}
+	if file.ETag == "" {
+		return sums
+	}
+
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	if md5ETagRegex.MatchString(file.ETag) && cc.sse.md5ETag(filePath) {
+		sums.MD5 = file.ETag
+	} else {
+		sums.MD5 = cc.entries[algoMD5+":"+file.ETag]
+	}
+	sums.SHA256 = cc.entries[algoSHA256+":"+file.ETag]
+	return sums
+}
+
+// Get returns the checksum of the file, streaming the object from S3 if it isn't known
+// nor stored by S3 with the object.
+func (cc *ChecksumCache) Get(ctx context.Context, filePath string, file File, algo string) (string, error) {
+	switch sums := cc.Cached(filePath, file); {
+	case algo == algoMD5 && sums.MD5 != "":
+		return sums.MD5, nil
+	case algo == algoSHA256 && sums.SHA256 != "":
+		return sums.SHA256, nil
+	}
+
+	var h hash.Hash
+	switch algo {
+	case algoMD5:
+		h = md5.New()
+	case algoSHA256:
+		h = sha256.New()
+	default:
+		return "", fmt.Errorf("unknown checksum algorithm %q", algo)
+	}
+
+	sum, err := cc.storedSum(ctx, filePath, algo)
+	if err != nil {
+		return "", err
+	}
+	if sum == "" {
+		cc.logger.Debug("computing checksum", zap.String("path", filePath), zap.String("algo", algo))
+
+		reader, _, _, err := cc.backend.GetObject(ctx, filePath, "")
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+
+		if _, err := io.Copy(h, reader); err != nil {
+			return "", err
+		}
+		sum = hex.EncodeToString(h.Sum(nil))
+	}
+
+	if file.ETag != "" {
+		cc.lock.Lock()
+		if len(cc.entries) >= maxChecksumEntries {
+			// Drop a random entry, it will be computed again if needed
+			for k := range cc.entries {
+				delete(cc.entries, k)
+				break
+			}
+		}
+		cc.entries[algo+":"+file.ETag] = sum
+		cc.lock.Unlock()
+	}
+
+	return sum, nil
+}
+
+// storedSum returns the checksum stored with the object by the backend, empty if there is none.
+func (cc *ChecksumCache) storedSum(ctx context.Context, filePath string, algo string) (string, error) {
+	stored, ok := cc.backend.(storedChecksums)
+	if !ok || algo != algoSHA256 {
+		return "", nil
+	}
+	return stored.StoredSHA256(ctx, filePath)
+}
+
+// checksumTarget checks if `fullPath` is a virtual checksum file.
+// It returns the checksum algorithm and the file (or directory for SHA256SUMS) it covers.
+// Objects really stored in the bucket always have precedence.
+func (b *S3Browser) checksumTarget(fullPath string) (string, string, bool) {
+	fullPath = normalizePath(fullPath)
+
+	if path.Base(fullPath) == sumsFileName {
+		dirPath := path.Dir(fullPath)
+		_, ok := b.s3Cache.GetDir(dirPath)
+		return algoSHA256, dirPath, ok
+	}
+
+	ext := path.Ext(fullPath)
+	algo := strings.TrimPrefix(ext, ".")
+	if algo != algoMD5 && algo != algoSHA256 {
+		return "", "", false
+	}
+	filePath := strings.TrimSuffix(fullPath, ext)
+	_, ok := b.s3Cache.GetFile(filePath)
+	return algo, filePath, ok
+}
+
+func (b *S3Browser) serveChecksum(w http.ResponseWriter, r *http.Request, algo string, targetPath string) error {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if dir, ok := b.s3Cache.GetDir(targetPath); ok {
+		// SHA256SUMS
+		if !b.allowed(r, permList, targetPath) {
+			return b.denied(r, targetPath)
+		}
+		dir = b.filterDir(r, dir)
+		var out strings.Builder
+		filesLeft, bytesLeft := maxSumsFiles, int64(maxSumsBytes)
+		incomplete := false
+		for _, name := range dir.Filenames {
+			if !b.allowed(r, permDownload, path.Join(dir.Path, name)) {
+				continue
+			}
+			file := dir.GetFile(name)
+			if b.checksums.Cached(path.Join(dir.Path, name), file).SHA256 == "" {
+				// Keep going, the checksums computed are cached for the next request
+				if filesLeft == 0 || file.Bytes > bytesLeft {
+					incomplete = true
+					continue
+				}
+				filesLeft--
+				bytesLeft -= file.Bytes
+			}
+			sum, err := b.checksums.Get(r.Context(), path.Join(dir.Path, name), file, algo)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&out, "%s  %s\n", sum, name)
+		}
+		if incomplete {
+			w.Header().Set("Retry-After", strconv.Itoa(int(sumsRetryInterval.Seconds())))
+			return caddyhttp.Error(http.StatusServiceUnavailable, errSumsIncomplete)
+		}
+		_, err := io.WriteString(w, out.String())
+		return err
+	}
+
+	if !b.allowed(r, permDownload, targetPath) {
+		return b.denied(r, targetPath)
+	}
+	file, _ := b.s3Cache.GetFile(targetPath)
+	sum, err := b.checksums.Get(r.Context(), targetPath, file, algo)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s  %s\n", sum, path.Base(targetPath))
+	return err
+}
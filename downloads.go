@@ -0,0 +1,245 @@
+package s3browser
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// defaultIgnoredAgents matches the user agents of common crawlers and link previewers.
+var defaultIgnoredAgents = []string{
+	`(?i)bot\b|crawl|spider|slurp|facebookexternalhit`,
+}
+
+// Kinds of downloads counted by DownloadStats
+const (
+	downloadComplete = iota // the whole file was sent
+	downloadPartial         // range request, or the client went away
+	downloadRedirect        // redirected to a presigned URL, completion is unknown
+)
+
+var downloadsBucket = []byte("downloads")
+
+// downloadDBs holds the open databases, shared by the configs using the same file
+// so a config reload doesn't wait for the lock of the previous config.
+var downloadDBs = caddy.NewUsagePool()
+
+type downloadDB struct {
+	*bbolt.DB
+}
+
+func (db downloadDB) Destruct() error {
+	return db.Close()
+}
+
+// DownloadCount is the number of downloads of a file.
+type DownloadCount struct {
+	Path       string    `json:"path"`
+	Complete   int64     `json:"complete"`
+	Partial    int64     `json:"partial"`
+	Redirected int64     `json:"redirected"`
+	Last       time.Time `json:"last"`
+}
+
+// Total counts the downloads displayed in listings, partial downloads are left out
+// since downloading a file in chunks makes many of them.
+func (c DownloadCount) Total() int64 {
+	return c.Complete + c.Redirected
+}
+
+// DownloadStats counts the downloads of each file in a bbolt database.
+type DownloadStats struct {
+	dbPath string
+	db     downloadDB
+	ignore []*regexp.Regexp
+	logger *zap.Logger
+}
+
+func NewDownloadStats(dbPath string, ignoreAgents []string, l *zap.Logger) (*DownloadStats, error) {
+	if len(ignoreAgents) == 0 {
+		ignoreAgents = defaultIgnoredAgents
+	}
+	ds := &DownloadStats{dbPath: dbPath, logger: l}
+	for _, expr := range ignoreAgents {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user agent pattern %q: %w", expr, err)
+		}
+		ds.ignore = append(ds.ignore, re)
+	}
+
+	val, _, err := downloadDBs.LoadOrNew(dbPath, func() (caddy.Destructor, error) {
+		if err := os.MkdirAll(filepath.Dir(dbPath), 0700); err != nil {
+			return nil, err
+		}
+		db, err := bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: time.Second})
+		if err != nil {
+			return nil, fmt.Errorf("opening %s: %w", dbPath, err)
+		}
+		err = db.Update(func(tx *bbolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(downloadsBucket)
+			return err
+		})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return downloadDB{db}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ds.db = val.(downloadDB)
+	return ds, nil
+}
+
+// Close releases the database, it is closed once no config uses it.
+func (ds *DownloadStats) Close() error {
+	_, err := downloadDBs.Delete(ds.dbPath)
+	return err
+}
+
+// ignored checks if the request comes from a bot.
+func (ds *DownloadStats) ignored(r *http.Request) bool {
+	agent := r.UserAgent()
+	for _, re := range ds.ignore {
+		if re.MatchString(agent) {
+			return true
+		}
+	}
+	return false
+}
+
+// Record counts a download of `filePath`. Errors are only logged, they must not fail the download.
+func (ds *DownloadStats) Record(r *http.Request, filePath string, kind int) {
+	if r.Method != http.MethodGet || ds.ignored(r) {
+		return
+	}
+	err := ds.db.Batch(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(downloadsBucket)
+		count := DownloadCount{}
+		if data := bucket.Get([]byte(filePath)); data != nil {
+			if err := json.Unmarshal(data, &count); err != nil {
+				return err
+			}
+		}
+		count.Path = filePath
+		count.Last = time.Now().UTC()
+		switch kind {
+		case downloadComplete:
+			count.Complete++
+		case downloadPartial:
+			count.Partial++
+		case downloadRedirect:
+			count.Redirected++
+		}
+		data, err := json.Marshal(count)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(filePath), data)
+	})
+	if err != nil {
+		ds.logger.Error("recording download", zap.String("path", filePath), zap.Error(err))
+	}
+}
+
+// Under returns the counts of the files below `prefix`, or of the file itself.
+func (ds *DownloadStats) Under(prefix string) ([]DownloadCount, error) {
+	counts := []DownloadCount{}
+	dirPrefix := strings.TrimSuffix(prefix, "/") + "/"
+	err := ds.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(downloadsBucket)
+		if data := bucket.Get([]byte(prefix)); data != nil {
+			count := DownloadCount{}
+			if err := json.Unmarshal(data, &count); err != nil {
+				return err
+			}
+			counts = append(counts, count)
+		}
+		c := bucket.Cursor()
+		for k, data := c.Seek([]byte(dirPrefix)); k != nil && strings.HasPrefix(string(k), dirPrefix); k, data = c.Next() {
+			count := DownloadCount{}
+			if err := json.Unmarshal(data, &count); err != nil {
+				return err
+			}
+			counts = append(counts, count)
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// Totals returns the totals of the files of `dir`, for the listing column.
+func (ds *DownloadStats) Totals(dir Directory) map[string]int64 {
+	totals := map[string]int64{}
+	err := ds.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(downloadsBucket)
+		for _, name := range dir.Filenames {
+			data := bucket.Get([]byte(path.Join(dir.Path, name)))
+			if data == nil {
+				continue
+			}
+			count := DownloadCount{}
+			if err := json.Unmarshal(data, &count); err != nil {
+				return err
+			}
+			totals[name] = count.Total()
+		}
+		return nil
+	})
+	if err != nil {
+		ds.logger.Error("reading download counts", zap.String("dir", dir.Path), zap.Error(err))
+	}
+	return totals
+}
+
+// serveDownloadStats handles `GET <path>?stats`, listing the download counts
+// of the file or of the files below the directory, most downloaded first.
+func (b *S3Browser) serveDownloadStats(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, nil)
+	}
+	if !authorized(r, b.DownloadStatsSecret) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="s3browser"`)
+		return caddyhttp.Error(http.StatusUnauthorized, nil)
+	}
+
+	p := normalizePath(r.URL.Path)
+	if !b.allowed(r, permList, p) {
+		return b.denied(r, p)
+	}
+	all, err := b.downloads.Under(p)
+	if err != nil {
+		return err
+	}
+	counts := []DownloadCount{}
+	for _, count := range all {
+		if b.allowed(r, permList, count.Path) {
+			counts = append(counts, count)
+		}
+	}
+	sort.SliceStable(counts, func(i, j int) bool {
+		return counts[i].Total()+counts[i].Partial > counts[j].Total()+counts[j].Partial
+	})
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	return b.writeJSON(w, struct {
+		Path  string          `json:"path"`
+		Files []DownloadCount `json:"files"`
+	}{p, counts})
+}
@@ -0,0 +1,158 @@
+package s3browser
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// Values for upload_encryption
+const (
+	uploadEncryptionS3  = "s3"
+	uploadEncryptionKMS = "kms"
+)
+
+// SSECustomerKey selects the SSE-C key of the objects under Prefix.
+// The key is read from a file or an environment variable, so it never appears in the config.
+type SSECustomerKey struct {
+	Prefix string `json:"prefix"`
+	File   string `json:"file,omitempty"` // 32 bytes, raw or base64
+	Env    string `json:"env,omitempty"`  // name of the variable holding the base64 key
+}
+
+type prefixKey struct {
+	prefix string
+	sse    encrypt.ServerSide
+}
+
+// serverSideEncryption holds the encryption settings of the requests to S3.
+type serverSideEncryption struct {
+	customerKeys []prefixKey        // longest prefix first
+	upload       encrypt.ServerSide // SSE-S3 or SSE-KMS for new objects without a customer key, may be nil
+}
+
+func newServerSideEncryption(keys []SSECustomerKey, upload string, kmsKeyID string) (*serverSideEncryption, error) {
+	if len(keys) == 0 && upload == "" {
+		return nil, nil
+	}
+
+	e := &serverSideEncryption{}
+	for _, key := range keys {
+		sse, err := loadCustomerKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("SSE-C key for %s: %w", key.Prefix, err)
+		}
+		e.customerKeys = append(e.customerKeys, prefixKey{prefix: normalizePath(key.Prefix), sse: sse})
+	}
+	sort.SliceStable(e.customerKeys, func(i, j int) bool {
+		return len(e.customerKeys[i].prefix) > len(e.customerKeys[j].prefix)
+	})
+
+	switch upload {
+	case "":
+	case uploadEncryptionS3:
+		e.upload = encrypt.NewSSE()
+	case uploadEncryptionKMS:
+		sse, err := encrypt.NewSSEKMS(kmsKeyID, nil)
+		if err != nil {
+			return nil, err
+		}
+		e.upload = sse
+	default:
+		return nil, fmt.Errorf("unknown upload_encryption: %s", upload)
+	}
+	return e, nil
+}
+
+// loadCustomerKey reads the key, errors must not include it.
+func loadCustomerKey(key SSECustomerKey) (encrypt.ServerSide, error) {
+	var data []byte
+	switch {
+	case key.File != "" && key.Env != "":
+		return nil, fmt.Errorf("both a file and an environment variable are set")
+	case key.File != "":
+		var err error
+		if data, err = ioutil.ReadFile(key.File); err != nil {
+			return nil, err
+		}
+		data = bytes.TrimSpace(data)
+	case key.Env != "":
+		val, ok := os.LookupEnv(key.Env)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", key.Env)
+		}
+		data = []byte(val)
+	default:
+		return nil, fmt.Errorf("no file nor environment variable")
+	}
+
+	if len(data) != 32 {
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+		n, err := base64.StdEncoding.Decode(decoded, data)
+		if err != nil || n != 32 {
+			return nil, fmt.Errorf("the key must be 32 bytes, raw or base64")
+		}
+		data = decoded[:n]
+	}
+	return encrypt.NewSSEC(data)
+}
+
+// customerKey returns the SSE-C key of the object at `p`, nil if it has none.
+func (e *serverSideEncryption) customerKey(p string) encrypt.ServerSide {
+	if e == nil {
+		return nil
+	}
+	p = normalizePath(p)
+	for _, key := range e.customerKeys {
+		if isUnder(p, key.prefix) {
+			return key.sse
+		}
+	}
+	return nil
+}
+
+// md5ETag tells if the ETag of the object at `p` can be its MD5: S3 doesn't use the MD5 with SSE-C nor SSE-KMS.
+func (e *serverSideEncryption) md5ETag(p string) bool {
+	if e == nil {
+		return true
+	}
+	if e.customerKey(p) != nil {
+		return false
+	}
+	return e.upload == nil || e.upload.Type() != encrypt.KMS
+}
+
+// forUpload returns the encryption of a new object at `p`.
+func (e *serverSideEncryption) forUpload(p string) encrypt.ServerSide {
+	if sse := e.customerKey(p); sse != nil {
+		return sse
+	}
+	if e == nil {
+		return nil
+	}
+	return e.upload
+}
+
+// parseSSECustomerKey parses `sse_customer_key <prefix> file|env <value>`.
+func parseSSECustomerKey(d *caddyfile.Dispenser) (SSECustomerKey, error) {
+	key := SSECustomerKey{}
+	var source, value string
+	if !d.Args(&key.Prefix, &source, &value) {
+		return key, d.ArgErr()
+	}
+	switch source {
+	case "file":
+		key.File = value
+	case "env":
+		key.Env = value
+	default:
+		return key, d.Errf("key source must be file or env")
+	}
+	return key, nil
+}
@@ -0,0 +1,245 @@
+package s3browser
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// defaultFeedSize is used when feed_size is not set.
+const defaultFeedSize = 20
+
+// Values for `?format=`
+const (
+	formatAtom = "atom"
+	formatRSS  = "rss"
+)
+
+type feedItem struct {
+	Path string // relative to the feed directory
+	Link string
+	File File
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	ID      string     `xml:"id"`
+	Updated string     `xml:"updated"`
+	Links   []atomLink `xml:"link"`
+	Summary string     `xml:"summary"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string       `xml:"title"`
+	Link        string       `xml:"link"`
+	GUID        rssGUID      `xml:"guid"`
+	PubDate     string       `xml:"pubDate"`
+	Description string       `xml:"description"`
+	Enclosure   rssEnclosure `xml:"enclosure"`
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// recentFiles returns the `n` most recent files in `dir` and its subdirectories
+// that the requester can list. Only the S3FsCache is used.
+func (b *S3Browser) recentFiles(r *http.Request, dir Directory, n int) []feedItem {
+	baseURL := requestBaseURL(r)
+	var s subject
+	if b.acl != nil {
+		s = b.acl.subject(r)
+	}
+	hidden := map[string]bool{}
+
+	items := []feedItem{}
+	b.s3Cache.Walk(dir.Path, func(curr Directory) {
+		// Parents are visited first, hide the content of hidden directories
+		if curr.Path != dir.Path && (hidden[path.Dir(curr.Path)] || !b.acl.allowed(s, permList, curr.Path)) {
+			hidden[curr.Path] = true
+			return
+		}
+		for _, name := range curr.Filenames {
+			filePath := path.Join(curr.Path, name)
+			if !b.acl.allowed(s, permList, filePath) {
+				continue
+			}
+			items = append(items, feedItem{
+				Path: strings.TrimPrefix(strings.TrimPrefix(filePath, dir.Path), "/"),
+				Link: baseURL + (&url.URL{Path: filePath}).EscapedPath(),
+				File: curr.GetFile(name),
+			})
+		}
+	})
+
+	sort.SliceStable(items, func(l, r int) bool {
+		return items[l].File.Date.After(items[r].File.Date)
+	})
+	if len(items) > n {
+		items = items[:n]
+	}
+	return items
+}
+
+// requestBaseURL returns the scheme and host the client used to reach us.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func (b *S3Browser) serveFeed(w http.ResponseWriter, r *http.Request, dir Directory, format string) error {
+	size := b.FeedSize
+	if size <= 0 {
+		size = defaultFeedSize
+	}
+
+	baseURL := requestBaseURL(r)
+	dirURL := baseURL + (&url.URL{Path: dir.Path}).EscapedPath()
+	items := b.recentFiles(r, dir, size)
+
+	title := b.SiteName
+	if dir.Path != "/" {
+		title = dir.Path + " | " + b.SiteName
+	}
+
+	var updated time.Time
+	if len(items) > 0 {
+		updated = items[0].File.Date
+	}
+
+	var feed interface{}
+	switch format {
+	case formatAtom:
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		feed = newAtomFeed(title, dirURL, baseURL+r.URL.RequestURI(), updated, items)
+	case formatRSS:
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		feed = newRSSFeed(title, dirURL, updated, items)
+	default:
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("unknown feed format: %q", format))
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	if b.Debug {
+		enc.Indent("", "  ")
+	}
+	return enc.Encode(feed)
+}
+
+func newAtomFeed(title, dirURL, selfURL string, updated time.Time, items []feedItem) atomFeed {
+	feed := atomFeed{
+		Title:   title,
+		ID:      dirURL,
+		Updated: updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: dirURL},
+			{Href: selfURL, Rel: "self"},
+		},
+		Entries: []atomEntry{},
+	}
+	for _, item := range items {
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title: item.Path,
+			// Include the date so a re-uploaded file is a new entry
+			ID:      item.Link + "#" + item.File.Date.UTC().Format(time.RFC3339),
+			Updated: item.File.Date.UTC().Format(time.RFC3339),
+			Links: []atomLink{
+				{Href: item.Link},
+				{Href: item.Link, Rel: "enclosure", Type: mimeType(item.Path), Length: item.File.Bytes},
+			},
+			Summary: fmt.Sprintf("%s (%s)", item.Path, item.File.HumanSize()),
+		})
+	}
+	return feed
+}
+
+func newRSSFeed(title, dirURL string, updated time.Time, items []feedItem) rssFeed {
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       title,
+			Link:        dirURL,
+			Description: "Recently added files in " + title,
+			Items:       []rssItem{},
+		},
+	}
+	if !updated.IsZero() {
+		feed.Channel.LastBuildDate = updated.UTC().Format(time.RFC1123Z)
+	}
+	for _, item := range items {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title: item.Path,
+			Link:  item.Link,
+			GUID: rssGUID{
+				Value: item.Link + "#" + item.File.Date.UTC().Format(time.RFC3339),
+			},
+			PubDate:     item.File.Date.UTC().Format(time.RFC1123Z),
+			Description: fmt.Sprintf("%s (%s)", item.Path, item.File.HumanSize()),
+			Enclosure: rssEnclosure{
+				URL:    item.Link,
+				Length: item.File.Bytes,
+				Type:   mimeType(item.Path),
+			},
+		})
+	}
+	return feed
+}
+
+func mimeType(name string) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
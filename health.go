@@ -0,0 +1,161 @@
+package s3browser
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// healthS3Timeout bounds the S3 connectivity check.
+const healthS3Timeout = 5 * time.Second
+
+// healthS3TTL is how long the result of the S3 check is reused, the probes are anonymous.
+const healthS3TTL = 5 * time.Second
+
+// Values for `?health=`, an empty value runs every check
+const (
+	healthLive  = "live"
+	healthReady = "ready"
+)
+
+// Values for healthCheck.Status and healthReport.Status
+const (
+	healthOK   = "ok"
+	healthFail = "fail"
+)
+
+// healthReport is returned by `?health`.
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+type healthCheck struct {
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	LastRefresh *time.Time `json:"last_refresh,omitempty"`
+	Age         float64    `json:"age_seconds,omitempty"`
+	MaxAge      float64    `json:"max_age_seconds,omitempty"`
+	Duration    float64    `json:"duration_seconds,omitempty"`
+}
+
+// s3Health keeps the last result of the S3 check, see healthS3TTL.
+type s3Health struct {
+	lock    sync.Mutex // held during the check, concurrent probes wait for its result
+	checked time.Time
+	check   healthCheck
+}
+
+// readyMaxAge returns how old the last successful full refresh can be for the cache to be ready.
+func (b *S3Browser) readyMaxAge() time.Duration {
+	if b.HealthReadyMaxAge > 0 {
+		return b.HealthReadyMaxAge
+	}
+	return 3 * b.refresher.interval
+}
+
+// cacheCheck checks that the cache is loaded and that the last successful full refresh is younger than `maxAge`.
+// A zero `maxAge` only checks that the cache is loaded.
+func (b *S3Browser) cacheCheck(maxAge time.Duration) healthCheck {
+	check := healthCheck{Status: healthOK, MaxAge: maxAge.Seconds()}
+	last := b.refresher.LastSuccess()
+	if last.IsZero() {
+		check.Status = healthFail
+		check.Error = "cache not loaded"
+		return check
+	}
+	age := time.Since(last)
+	check.LastRefresh = &last
+	check.Age = age.Seconds()
+	if maxAge > 0 && age > maxAge {
+		check.Status = healthFail
+		check.Error = fmt.Sprintf("last successful refresh is older than %s", maxAge)
+	}
+	return check
+}
+
+// s3Check makes a request to S3, unless the last one is younger than healthS3TTL.
+func (b *S3Browser) s3Check(ctx context.Context) healthCheck {
+	h := b.s3Health
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if time.Since(h.checked) < healthS3TTL {
+		return h.check
+	}
+
+	check := b.checkS3(ctx)
+	// The failure of a request given up by its client says nothing about S3
+	if ctx.Err() == nil {
+		h.checked = time.Now()
+		h.check = check
+	}
+	return check
+}
+
+func (b *S3Browser) checkS3(ctx context.Context) healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, healthS3Timeout)
+	defer cancel()
+
+	check := healthCheck{Status: healthOK}
+	start := time.Now()
+	exists, err := b.s3Client().BucketExists(ctx)
+	check.Duration = time.Since(start).Seconds()
+	if err == nil && !exists {
+		err = fmt.Errorf("bucket not found")
+	}
+	if err != nil {
+		check.Status = healthFail
+		check.Error = err.Error()
+	}
+	return check
+}
+
+// serveHealth handles the probes, no authentication is needed:
+//   - GET ?health=live: fails when the last successful full refresh is older than health_live_max_age
+//   - GET ?health=ready: fails until the cache is loaded, when it is older than health_ready_max_age
+//     and, with health_check_s3, when S3 can't be reached
+//   - GET ?health: every check, including S3
+func (b *S3Browser) serveHealth(w http.ResponseWriter, r *http.Request, probe string) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, nil)
+	}
+
+	checks := map[string]healthCheck{}
+	switch probe {
+	case healthLive:
+		if b.HealthLiveMaxAge > 0 {
+			checks["cache"] = b.cacheCheck(b.HealthLiveMaxAge)
+		}
+	case healthReady:
+		checks["cache"] = b.cacheCheck(b.readyMaxAge())
+		if b.HealthCheckS3 {
+			checks["s3"] = b.s3Check(r.Context())
+		}
+	case "":
+		checks["cache"] = b.cacheCheck(b.readyMaxAge())
+		if b.s3Client() != nil {
+			checks["s3"] = b.s3Check(r.Context())
+		}
+	default:
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("unknown health probe: %q", probe))
+	}
+
+	report := healthReport{Status: healthOK, Checks: checks}
+	for _, check := range checks {
+		if check.Status != healthOK {
+			report.Status = healthFail
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != healthOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return b.writeJSON(w, report)
+}
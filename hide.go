@@ -0,0 +1,191 @@
+package s3browser
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// maxIgnoreFileSize bounds what is read from the ignore files.
+const maxIgnoreFileSize = 64 << 10 // 64 KiB
+
+// hider decides which files and folders are hidden.
+//
+// Glob patterns without a "/" (besides a trailing one) match the name of the entry
+// at any depth, others match its whole path (see matchGlob); a trailing "/" only matches folders.
+// Regexps match the whole path, with a trailing "/" for folders.
+// Patterns of an ignore file are relative to the directory holding it.
+type hider struct {
+	globs       []string
+	regexps     []*regexp.Regexp
+	listingOnly bool   // hidden entries are only removed from listings
+	ignoreFile  string // name of the per-directory ignore files, "" if disabled
+}
+
+func newHider(globs []string, regexps []string, listingOnly bool, ignoreFile string) (*hider, error) {
+	if len(globs) == 0 && len(regexps) == 0 && ignoreFile == "" {
+		return nil, nil
+	}
+
+	h := &hider{globs: globs, listingOnly: listingOnly, ignoreFile: ignoreFile}
+	for _, glob := range globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid hide pattern %q: %v", glob, err)
+		}
+	}
+	for _, expr := range regexps {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hide_regex %q: %v", expr, err)
+		}
+		h.regexps = append(h.regexps, re)
+	}
+	return h, nil
+}
+
+// hidden checks if the entry at `p` is hidden.
+// `ignores` holds the patterns of the ignore files by directory.
+func (h *hider) hidden(ignores map[string][]string, p string, isDir bool) bool {
+	if h == nil || p == "/" {
+		return false
+	}
+	if h.ignoreFile != "" && !isDir && path.Base(p) == h.ignoreFile {
+		return true
+	}
+
+	for _, glob := range h.globs {
+		if matchHidePattern(glob, p, isDir) {
+			return true
+		}
+	}
+	full := p
+	if isDir {
+		full += "/"
+	}
+	for _, re := range h.regexps {
+		if re.MatchString(full) {
+			return true
+		}
+	}
+
+	for dirPath := path.Dir(p); ; dirPath = path.Dir(dirPath) {
+		for _, pattern := range ignores[dirPath] {
+			if matchHidePattern(pattern, strings.TrimPrefix(p, strings.TrimSuffix(dirPath, "/")), isDir) {
+				return true
+			}
+		}
+		if dirPath == "/" {
+			break
+		}
+	}
+	return false
+}
+
+// matchHidePattern matches the glob `pattern` against the path `p`, relative to where the pattern is defined.
+func matchHidePattern(pattern string, p string, isDir bool) bool {
+	if strings.HasSuffix(pattern, "/") {
+		if !isDir {
+			return false
+		}
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(p))
+		return ok
+	}
+	return matchGlob(pattern, p)
+}
+
+// parseIgnoreFile returns the patterns of an ignore file, one per line, `#` starts a comment.
+func parseIgnoreFile(r io.Reader) []string {
+	patterns := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns
+}
+
+// loadIgnoreFiles reads the ignore files found in `data`.
+// An ignore file that can't be read is skipped, the refresh goes on.
+func (fs *S3FsCache) loadIgnoreFiles(ctx context.Context, data map[string]Directory) map[string][]string {
+	ignores := map[string][]string{}
+	if fs.hide == nil || fs.hide.ignoreFile == "" {
+		return ignores
+	}
+
+	for dirPath, dir := range data {
+		if _, ok := dir.files[fs.hide.ignoreFile]; !ok {
+			continue
+		}
+		filePath := path.Join(dirPath, fs.hide.ignoreFile)
+		reader, _, _, err := fs.backend.GetObject(ctx, filePath, "")
+		if err != nil {
+			fs.logger.Warn("could not read ignore file", zap.String("path", filePath), zap.Error(err))
+			continue
+		}
+		ignores[dirPath] = parseIgnoreFile(io.LimitReader(reader, maxIgnoreFileSize))
+		reader.Close()
+	}
+	return ignores
+}
+
+// applyHide removes the hidden entries below `root` from `data`, only from the listings with listingOnly.
+// The directories below `root` are modified in place, they must not be shared yet.
+func (fs *S3FsCache) applyHide(data map[string]Directory, ignores map[string][]string, root string) {
+	if fs.hide == nil {
+		return
+	}
+
+	var removeTree func(string)
+	removeTree = func(dirPath string) {
+		for _, name := range data[dirPath].Folders {
+			removeTree(path.Join(dirPath, name))
+		}
+		delete(data, dirPath)
+	}
+
+	var walk func(string)
+	walk = func(dirPath string) {
+		dir := data[dirPath]
+
+		folders := []string{}
+		for _, name := range dir.Folders {
+			currPath := path.Join(dirPath, name)
+			if !fs.hide.hidden(ignores, currPath, true) {
+				folders = append(folders, name)
+			} else if !fs.hide.listingOnly {
+				removeTree(currPath)
+				continue
+			}
+			walk(currPath)
+		}
+		dir.Folders = folders
+
+		filenames := []string{}
+		for _, name := range dir.Filenames {
+			if !fs.hide.hidden(ignores, path.Join(dirPath, name), false) {
+				filenames = append(filenames, name)
+			} else if !fs.hide.listingOnly {
+				delete(dir.files, name)
+			}
+		}
+		dir.Filenames = filenames
+
+		data[dirPath] = dir
+	}
+	walk(root)
+}
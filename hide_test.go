@@ -0,0 +1,92 @@
+package s3browser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHiderHidden(t *testing.T) {
+	h, err := newHider(
+		[]string{".*", "*.tmp", "build/", "/private/**", "/docs/draft-*"},
+		[]string{`^/logs/\d{4}/$`, `\.bak$`},
+		false, ".hidden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ignores := map[string][]string{
+		"/":         {"/root-only.txt"},
+		"/projects": {"*.o", "/vendor/", "cache/**"},
+	}
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"/", true, false},
+		{"/a.txt", false, false},
+		// Names at any depth
+		{"/.git", true, true},
+		{"/docs/.env", false, true},
+		{"/docs/a.tmp", false, true},
+		{"/docs/a.tmp.txt", false, false},
+		// Trailing slash: folders only
+		{"/src/build", true, true},
+		{"/src/build", false, false},
+		// Whole paths
+		{"/private", true, true},
+		{"/private/a/b.txt", false, true},
+		{"/privateer.txt", false, false},
+		{"/docs/draft-1.md", false, true},
+		{"/docs/sub/draft-1.md", false, false},
+		// Regexps, folders with a trailing slash
+		{"/logs/2024", true, true},
+		{"/logs/2024", false, false},
+		{"/logs/2024/a.log", false, false},
+		{"/a.bak", false, true},
+		// The ignore files themselves
+		{"/docs/.hidden", false, true},
+		// Patterns of the ignore files are relative to their directory
+		{"/root-only.txt", false, true},
+		{"/docs/root-only.txt", false, false},
+		{"/projects/main.o", false, true},
+		{"/projects/lib/util.o", false, true},
+		{"/main.o", false, false},
+		{"/projects/vendor", true, true},
+		{"/projects/lib/vendor", true, false},
+		{"/projects/vendor", false, false},
+		{"/projects/cache/x/y", false, true},
+		{"/cache/x", false, false},
+	}
+	for _, tt := range tests {
+		if got := h.hidden(ignores, tt.path, tt.isDir); got != tt.want {
+			t.Errorf("hidden(%q, dir=%v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+
+	var none *hider
+	if none.hidden(ignores, "/.git", true) {
+		t.Error("hidden without patterns")
+	}
+}
+
+func TestNewHider(t *testing.T) {
+	if h, err := newHider(nil, nil, true, ""); h != nil || err != nil {
+		t.Errorf("without patterns: got %v, %v", h, err)
+	}
+	if _, err := newHider([]string{"[a"}, nil, false, ""); err == nil {
+		t.Error("no error for an invalid glob")
+	}
+	if _, err := newHider(nil, []string{"(a"}, false, ""); err == nil {
+		t.Error("no error for an invalid regexp")
+	}
+}
+
+func TestParseIgnoreFile(t *testing.T) {
+	got := parseIgnoreFile(strings.NewReader("# comment\n*.o\n\n  build/  \n[invalid\n/a/**\n"))
+	want := []string{"*.o", "build/", "/a/**"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
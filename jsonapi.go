@@ -0,0 +1,245 @@
+package s3browser
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// jsonAPIVersion is the version of the JSON listing schema, it changes on incompatible changes only.
+const jsonAPIVersion = 1
+
+// formatJSON selects the JSON listing with `?format=`, like the Accept header.
+const formatJSON = "json"
+
+// Listing formats without a `?format=` value, used as metric labels
+const (
+	formatHTML = "html"
+	formatTree = "tree"
+)
+
+// Pagination of the JSON listing
+const (
+	defaultJSONLimit = 1000
+	maxJSONLimit     = 10000
+)
+
+// Values for `?sort=` and `?order=`
+const (
+	sortName  = "name"
+	sortSize  = "size"
+	sortMtime = "mtime"
+	orderAsc  = "asc"
+	orderDesc = "desc"
+)
+
+// Values for jsonEntry.Type
+const (
+	entryDir  = "dir"
+	entryFile = "file"
+)
+
+// jsonListing is the v1 JSON listing of a directory.
+type jsonListing struct {
+	Version     int              `json:"version"`
+	Path        string           `json:"path"`
+	Breadcrumbs []jsonBreadcrumb `json:"breadcrumbs"`
+	Entries     []jsonEntry      `json:"entries"`
+	Sort        string           `json:"sort,omitempty"` // empty when in the listing order
+	Order       string           `json:"order"`
+	Offset      int              `json:"offset"`
+	Limit       int              `json:"limit"`
+	Total       int              `json:"total"`
+	Next        string           `json:"next,omitempty"` // URL of the next page, if any
+}
+
+type jsonBreadcrumb struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// jsonEntry is a folder or a file, size, mtime, etag and checksums are only set for files.
+type jsonEntry struct {
+	Name      string     `json:"name"`
+	Path      string     `json:"path"`
+	Type      string     `json:"type"`
+	Size      *int64     `json:"size,omitempty"`
+	Mtime     *time.Time `json:"mtime,omitempty"`
+	ETag      string     `json:"etag,omitempty"`
+	URL       string     `json:"url"`
+	Checksums *Checksums `json:"checksums,omitempty"`
+}
+
+// wantsJSON checks if the JSON listing is requested, with `?format=json` or the Accept header.
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == formatJSON {
+		return true
+	}
+	acceptHeader := strings.ToLower(strings.Join(r.Header["Accept"], ","))
+	return strings.Contains(acceptHeader, "application/json")
+}
+
+// jsonListingOf builds the JSON listing of `dir`, sorted and paginated as requested by `query`.
+func (b *S3Browser) jsonListingOf(baseURL string, dir Directory, query url.Values) (jsonListing, error) {
+	out := jsonListing{
+		Version: jsonAPIVersion,
+		Path:    dir.Path,
+		Entries: []jsonEntry{},
+		Sort:    query.Get("sort"),
+		Order:   query.Get("order"),
+		Limit:   defaultJSONLimit,
+	}
+
+	for _, crumb := range breadcrumbs(TemplateArgs{SiteName: b.SiteName, Dir: dir}) {
+		out.Breadcrumbs = append(out.Breadcrumbs, jsonBreadcrumb{Name: crumb.Name, Path: crumb.Link})
+	}
+
+	switch out.Sort {
+	case "", sortName, sortSize, sortMtime:
+	default:
+		return out, fmt.Errorf("invalid sort: %q", out.Sort)
+	}
+	switch out.Order {
+	case "":
+		out.Order = orderAsc
+	case orderAsc, orderDesc:
+	default:
+		return out, fmt.Errorf("invalid order: %q", out.Order)
+	}
+	var err error
+	if val := query.Get("limit"); val != "" {
+		if out.Limit, err = strconv.Atoi(val); err != nil || out.Limit <= 0 || out.Limit > maxJSONLimit {
+			return out, fmt.Errorf("invalid limit: %q", val)
+		}
+	}
+	if val := query.Get("offset"); val != "" {
+		if out.Offset, err = strconv.Atoi(val); err != nil || out.Offset < 0 {
+			return out, fmt.Errorf("invalid offset: %q", val)
+		}
+	}
+
+	folders := []jsonEntry{}
+	for _, name := range dir.Folders {
+		folders = append(folders, dirEntry(baseURL, dir.Path, name))
+	}
+	files := []jsonEntry{}
+	for _, name := range dir.Filenames {
+		files = append(files, b.fileEntry(baseURL, dir.Path, name, dir.GetFile(name)))
+	}
+
+	// Folders always come first, they have no size nor mtime and stay sorted by name
+	sortEntries(folders, out.Sort, out.Order)
+	sortEntries(files, out.Sort, out.Order)
+	entries := append(folders, files...)
+
+	out.Total = len(entries)
+	if out.Offset < len(entries) {
+		end := out.Offset + out.Limit
+		if end > len(entries) {
+			end = len(entries)
+		}
+		out.Entries = entries[out.Offset:end]
+	}
+	if out.Offset+out.Limit < len(entries) {
+		next := url.Values{}
+		for key, values := range query {
+			next[key] = values
+		}
+		next.Set("format", formatJSON)
+		next.Set("offset", strconv.Itoa(out.Offset+out.Limit))
+		next.Set("limit", strconv.Itoa(out.Limit))
+		out.Next = baseURL + (&url.URL{Path: dir.Path, RawQuery: next.Encode()}).RequestURI()
+	}
+	return out, nil
+}
+
+func dirEntry(baseURL string, dirPath string, name string) jsonEntry {
+	fullPath := path.Join(dirPath, name)
+	return jsonEntry{
+		Name: name,
+		Path: fullPath,
+		Type: entryDir,
+		URL:  baseURL + (&url.URL{Path: fullPath + "/"}).EscapedPath(),
+	}
+}
+
+func (b *S3Browser) fileEntry(baseURL string, dirPath string, name string, file File) jsonEntry {
+	fullPath := path.Join(dirPath, name)
+	entry := jsonEntry{
+		Name:  name,
+		Path:  fullPath,
+		Type:  entryFile,
+		Size:  &file.Bytes,
+		Mtime: &file.Date,
+		ETag:  strings.Trim(file.ETag, `"`),
+		URL:   baseURL + (&url.URL{Path: fullPath}).EscapedPath(),
+	}
+	if b.checksums != nil {
+		if sums := b.checksums.Cached(fullPath, file); sums != (Checksums{}) {
+			entry.Checksums = &sums
+		}
+	}
+	return entry
+}
+
+// sortEntries sorts by `field`, an empty field keeps the listing order (see sort_algorithm).
+func sortEntries(entries []jsonEntry, field string, order string) {
+	byName := func(l, r jsonEntry) bool {
+		if ln, rn := strings.ToLower(l.Name), strings.ToLower(r.Name); ln != rn {
+			return ln < rn
+		}
+		return l.Name < r.Name
+	}
+
+	var less func(l, r jsonEntry) bool
+	switch field {
+	case sortName:
+		less = byName
+	case sortSize:
+		less = func(l, r jsonEntry) bool {
+			if l.Size == nil || r.Size == nil || *l.Size == *r.Size {
+				return byName(l, r)
+			}
+			return *l.Size < *r.Size
+		}
+	case sortMtime:
+		less = func(l, r jsonEntry) bool {
+			if l.Mtime == nil || r.Mtime == nil || l.Mtime.Equal(*r.Mtime) {
+				return byName(l, r)
+			}
+			return l.Mtime.Before(*r.Mtime)
+		}
+	default:
+		if order == orderDesc {
+			for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+				entries[i], entries[j] = entries[j], entries[i]
+			}
+		}
+		return
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if order == orderDesc {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+}
+
+func (b *S3Browser) serveJSON(w http.ResponseWriter, r *http.Request, dir Directory) error {
+	out, err := b.jsonListingOf(requestBaseURL(r), dir, r.URL.Query())
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Vary", "Accept")
+	return b.writeJSON(w, out)
+}
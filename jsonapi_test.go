@@ -0,0 +1,142 @@
+package s3browser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Run `go test -update` to rewrite the golden files after an intended change of the output.
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// testDate is the date of every test object, so the outputs don't change between runs.
+var testDate = time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+// testObjects is the content of the bucket of newTestBrowser.
+var testObjects = map[string]string{
+	"README.md":            "# Test bucket\n",
+	"b.txt":                "0123456789",
+	"a.txt":                "hello",
+	"docs/guide.txt":       "read me first",
+	"docs/api/v1.json":     `{"version":1}`,
+	"docs/api/v2.json":     `{"version":2}`,
+	"photos/2023/cat.jpg":  "not really a cat",
+	"photos/2023/dog.jpeg": "not really a dog",
+}
+
+// newTestBrowser provisions `b` with a MemoryBackend holding testObjects.
+func newTestBrowser(t *testing.T, b *S3Browser) *S3Browser {
+	t.Helper()
+
+	mb := NewMemoryBackend()
+	for key, content := range testObjects {
+		if _, err := mb.PutObject(context.Background(), key, strings.NewReader(content), int64(len(content)), ""); err != nil {
+			t.Fatal(err)
+		}
+		obj := mb.objects[key]
+		obj.info.LastModified = testDate
+		mb.objects[key] = obj
+	}
+
+	if b.SiteName == "" {
+		b.SiteName = "Test"
+	}
+	b.Backend = backendMemory
+	b.store = mb
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := b.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// serve runs the request through ServeHTTP, the error is the one returned to Caddy.
+func serve(b *S3Browser, r *http.Request) (*httptest.ResponseRecorder, error) {
+	w := httptest.NewRecorder()
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return caddyhttp.Error(http.StatusTeapot, nil)
+	})
+	err := b.ServeHTTP(w, r, next)
+	return w, err
+}
+
+// checkGolden compares `got` with testdata/<name>.golden.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	goldenPath := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		if err := ioutil.WriteFile(goldenPath, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from %s (run go test -update if intended):\n%s", name, goldenPath, got)
+	}
+}
+
+func TestJSONListing(t *testing.T) {
+	b := newTestBrowser(t, &S3Browser{Checksums: true})
+
+	tests := []struct {
+		name   string
+		target string
+		accept string
+	}{
+		{"jsonapi_root", "/?format=json", ""},
+		{"jsonapi_accept", "/docs/", "application/json"},
+		{"jsonapi_sorted", "/?format=json&sort=size&order=desc", ""},
+		{"jsonapi_page", "/?format=json&limit=2&offset=1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.target, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w, err := serve(b, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+				t.Errorf("Content-Type: %q", ct)
+			}
+
+			var out bytes.Buffer
+			if err := json.Indent(&out, w.Body.Bytes(), "", "  "); err != nil {
+				t.Fatal(err)
+			}
+			out.WriteByte('\n')
+			checkGolden(t, tt.name, out.Bytes())
+		})
+	}
+}
+
+func TestJSONListingInvalidQuery(t *testing.T) {
+	b := newTestBrowser(t, &S3Browser{})
+
+	for _, target := range []string{"/?format=json&sort=color", "/?format=json&limit=-1"} {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com"+target, nil)
+		_, err := serve(b, r)
+		if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: got %v, want a 400 error", target, err)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package s3browser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// LocalBackend serves the files below a directory. Symbolic links and other special files are skipped.
+type LocalBackend struct {
+	root string
+}
+
+// errSymlink is returned for the keys with a symbolic link in their path, it could point outside of the root.
+var errSymlink = errors.New("symbolic links are not followed")
+
+func NewLocalBackend(root string) (*LocalBackend, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	return &LocalBackend{root: root}, nil
+}
+
+// filename returns the file of `key`, which can't be outside of the root.
+func (lb *LocalBackend) filename(key string) string {
+	return filepath.Join(lb.root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+// lstat returns the info of the file of `key`, without following symbolic links:
+// errSymlink is returned if any element of the path is one.
+func (lb *LocalBackend) lstat(key string) (os.FileInfo, error) {
+	name := lb.root
+	info, err := os.Stat(name) // the root itself may be a link
+	for _, elem := range strings.Split(path.Clean("/"+key), "/") {
+		if elem == "" {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, os.ErrNotExist
+		}
+		name = filepath.Join(name, elem)
+		if info, err = os.Lstat(name); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return nil, errSymlink
+		}
+	}
+	return info, err
+}
+
+// stat returns the info of the regular file of `key`.
+func (lb *LocalBackend) stat(key string) (os.FileInfo, error) {
+	info, err := lb.lstat(key)
+	if os.IsNotExist(err) || err == errSymlink || (err == nil && !info.Mode().IsRegular()) {
+		return nil, noSuchKey(key)
+	}
+	return info, err
+}
+
+// objectInfo makes up the info S3 would return, the ETag changes with the size and modification time.
+func (lb *LocalBackend) objectInfo(key string, info os.FileInfo) minio.ObjectInfo {
+	if info.IsDir() {
+		return minio.ObjectInfo{Key: key + "/", LastModified: info.ModTime()}
+	}
+	return minio.ObjectInfo{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+		ETag:         fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size()),
+		ContentType:  mimeType(key),
+	}
+}
+
+// ForEachObjectIn walks the directories matching `prefix`, directories are listed as keys ending with a slash
+// so empty ones are browsable too.
+func (lb *LocalBackend) ForEachObjectIn(ctx context.Context, prefix string, fn func(minio.ObjectInfo)) error {
+	// Only walk the deepest directory containing every matching key
+	start := lb.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		// Walk doesn't follow links, but those in the path of the start
+		info, err := lb.lstat(prefix[:i])
+		switch {
+		case os.IsNotExist(err) || err == errSymlink:
+			return nil
+		case err != nil:
+			return err
+		case !info.IsDir():
+			return nil
+		}
+		start = lb.filename(prefix[:i])
+	}
+	err := filepath.Walk(start, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && name == start {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if name == lb.root {
+			return nil
+		}
+		rel, err := filepath.Rel(lb.root, name)
+		if err != nil {
+			return err
+		}
+		obj := lb.objectInfo(filepath.ToSlash(rel), info)
+		switch {
+		case !info.IsDir() && !info.Mode().IsRegular():
+			return nil
+		case strings.HasPrefix(obj.Key, prefix):
+			fn(obj)
+		case info.IsDir() && !strings.HasPrefix(prefix, obj.Key):
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func (lb *LocalBackend) StatObject(ctx context.Context, filePath string) (minio.ObjectInfo, error) {
+	key := strings.TrimLeft(filePath, "/")
+	info, err := lb.stat(key)
+	if err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	return lb.objectInfo(key, info), nil
+}
+
+func (lb *LocalBackend) GetObject(ctx context.Context, filePath string, rangeHdr string) (io.ReadCloser, minio.ObjectInfo, http.Header, error) {
+	key := strings.TrimLeft(filePath, "/")
+	fileInfo, err := lb.stat(key)
+	if err != nil {
+		return nil, minio.ObjectInfo{}, nil, err
+	}
+	info := lb.objectInfo(key, fileInfo)
+	f, err := os.Open(lb.filename(key))
+	if err != nil {
+		return nil, info, nil, err
+	}
+	// Replaced by a link since checked
+	if opened, err := f.Stat(); err != nil || !os.SameFile(opened, fileInfo) {
+		f.Close()
+		return nil, info, nil, noSuchKey(key)
+	}
+	reader, headers, err := readObject(f, info, rangeHdr)
+	if err != nil {
+		f.Close()
+		return nil, info, nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{reader, f}, info, headers, nil
+}
+
+func (lb *LocalBackend) PresignedGetObject(ctx context.Context, filePath string, expiry time.Duration, params url.Values) (*url.URL, error) {
+	return nil, errPresignUnsupported
+}
+
+// PutObject writes to a temporary file renamed once complete, so readers never see a partial file.
+// A key ending with a slash creates a directory.
+func (lb *LocalBackend) PutObject(ctx context.Context, filePath string, reader io.Reader, size int64, contentType string) (minio.ObjectInfo, error) {
+	key := strings.TrimLeft(filePath, "/")
+	name := lb.filename(key)
+	// MkdirAll and the rename would follow the links
+	if _, err := lb.lstat(path.Dir(strings.TrimSuffix(key, "/"))); err == errSymlink {
+		return minio.ObjectInfo{}, err
+	}
+	if strings.HasSuffix(key, "/") {
+		if err := os.MkdirAll(name, 0755); err != nil {
+			return minio.ObjectInfo{}, err
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return minio.ObjectInfo{}, err
+		}
+		return lb.objectInfo(strings.TrimSuffix(key, "/"), info), nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	defer os.Remove(tmp.Name()) // fails once renamed
+	if _, err := io.Copy(tmp, reader); err != nil {
+		tmp.Close()
+		return minio.ObjectInfo{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	return lb.StatObject(ctx, key)
+}
@@ -0,0 +1,89 @@
+package s3browser
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// newTestLocalBackend returns a backend on a new directory, next to a secret file it must not serve.
+// The directory has a file, and links to the secret and to its directory.
+func newTestLocalBackend(t *testing.T) *LocalBackend {
+	t.Helper()
+
+	dir := t.TempDir()
+	outside := filepath.Join(dir, "outside")
+	root := filepath.Join(dir, "root")
+	for _, name := range []string{outside, filepath.Join(root, "sub")} {
+		if err := os.MkdirAll(name, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(outside, "secret.txt"): "secret",
+		filepath.Join(root, "sub", "a.txt"):  "hello",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(root, "secret.txt"):   filepath.Join(outside, "secret.txt"),
+		filepath.Join(root, "linked"):       outside,
+		filepath.Join(root, "sub", "b.txt"): filepath.Join(root, "sub", "a.txt"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, name); err != nil {
+			t.Skip("no symbolic links:", err)
+		}
+	}
+
+	lb, err := NewLocalBackend(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lb
+}
+
+func TestLocalBackendSymlinks(t *testing.T) {
+	lb := newTestLocalBackend(t)
+	ctx := context.Background()
+
+	keys := []string{}
+	for _, prefix := range []string{"", "linked/", "sub/"} {
+		if err := lb.ForEachObjectIn(ctx, prefix, func(obj minio.ObjectInfo) { keys = append(keys, obj.Key) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := strings.Join(keys, ","); got != "sub/,sub/a.txt,sub/,sub/a.txt" {
+		t.Errorf("listed %s", got)
+	}
+
+	for _, key := range []string{"secret.txt", "linked/secret.txt", "sub/b.txt"} {
+		if _, err := lb.StatObject(ctx, key); minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			t.Errorf("StatObject(%s): got %v, want NoSuchKey", key, err)
+		}
+		if _, _, _, err := lb.GetObject(ctx, key, ""); minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			t.Errorf("GetObject(%s): got %v, want NoSuchKey", key, err)
+		}
+	}
+
+	if _, err := lb.PutObject(ctx, "linked/new.txt", strings.NewReader("new"), 3, ""); err != errSymlink {
+		t.Errorf("PutObject through a link: got %v", err)
+	}
+
+	reader, info, _, err := lb.GetObject(ctx, "/sub/a.txt", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if data, _ := ioutil.ReadAll(reader); string(data) != "hello" || info.Size != 5 {
+		t.Errorf("GetObject: got %q, %d bytes", data, info.Size)
+	}
+}
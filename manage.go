@@ -0,0 +1,354 @@
+package s3browser
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// Values for `?manage=`
+const (
+	manageLogin  = "login"
+	manageDelete = "delete"
+	manageRename = "rename"
+	manageMkdir  = "mkdir"
+)
+
+// manageRequest is the body of JSON management requests.
+type manageRequest struct {
+	To   string `json:"to,omitempty"`   // rename: new name, or new absolute path
+	Name string `json:"name,omitempty"` // mkdir: name of the new folder
+}
+
+type manageResponse struct {
+	Path string `json:"path"`
+}
+
+// The functions below change the bucket and patch `cache` right away,
+// they are shared by the HTML UI and WebDAV.
+// Errors from the os package (ErrNotExist, ErrExist, ErrPermission) describe invalid operations.
+
+// allowFunc reports whether the requester has the permission `perm` on `p`, see accessControl.
+// The callers check the paths they are given, the functions check the objects in folders.
+type allowFunc func(perm string, p string) bool
+
+// checkKeys returns os.ErrPermission unless `perm` is allowed on every key.
+func checkKeys(allowed allowFunc, perm string, keys []string) error {
+	for _, key := range keys {
+		if !allowed(perm, normalizePath("/"+key)) {
+			return os.ErrPermission
+		}
+	}
+	return nil
+}
+
+// makeDir creates the folder `name`, S3 has no directories so
+// a zero-byte "<name>/" object keeps it listed while empty.
+func makeDir(ctx context.Context, cache *S3FsCache, client S3Client, name string) error {
+	name = normalizePath(name)
+	if _, ok := cache.GetDir(name); ok {
+		return os.ErrExist
+	}
+	if _, ok := cache.GetFile(name); ok {
+		return os.ErrExist
+	}
+	if _, ok := cache.GetDir(path.Dir(name)); !ok {
+		return os.ErrNotExist
+	}
+
+	obj, err := client.PutObject(ctx, name+"/", bytes.NewReader(nil), 0, "")
+	if err != nil {
+		return err
+	}
+	cache.AddObject(obj)
+	return nil
+}
+
+// removePath deletes the file `name`, or the folder `name` and everything in it.
+func removePath(ctx context.Context, cache *S3FsCache, client S3Client, allowed allowFunc, name string) error {
+	name = normalizePath(name)
+	if name == "/" {
+		return os.ErrPermission
+	}
+
+	if _, ok := cache.GetDir(name); ok {
+		keys, err := keysUnder(ctx, client, name)
+		if err != nil {
+			return err
+		}
+		if err := checkKeys(allowed, permDelete, keys); err != nil {
+			return err
+		}
+		if err := client.RemoveObjects(ctx, keys); err != nil {
+			return err
+		}
+	} else if _, ok := cache.GetFile(name); ok {
+		if err := client.RemoveObject(ctx, name); err != nil {
+			return err
+		}
+	} else {
+		return os.ErrNotExist
+	}
+
+	cache.Remove(name)
+	return nil
+}
+
+// renamePath copies the objects server-side, then deletes the originals.
+// An existing file at `newName` is replaced.
+func renamePath(ctx context.Context, cache *S3FsCache, client S3Client, allowed allowFunc, oldName, newName string) error {
+	oldName, newName = normalizePath(oldName), normalizePath(newName)
+	if oldName == "/" || newName == "/" || strings.HasPrefix(newName, oldName+"/") {
+		return os.ErrPermission
+	}
+	if _, ok := cache.GetDir(path.Dir(newName)); !ok {
+		return os.ErrNotExist
+	}
+
+	if _, ok := cache.GetDir(oldName); ok {
+		keys, err := keysUnder(ctx, client, oldName)
+		if err != nil {
+			return err
+		}
+		oldPrefix := strings.TrimLeft(oldName, "/") + "/"
+		newPrefix := strings.TrimLeft(newName, "/") + "/"
+		newKeys := make([]string, 0, len(keys))
+		for _, key := range keys {
+			newKeys = append(newKeys, newPrefix+strings.TrimPrefix(key, oldPrefix))
+		}
+		if err := checkKeys(allowed, permDelete, keys); err != nil {
+			return err
+		}
+		if err := checkKeys(allowed, permUpload, newKeys); err != nil {
+			return err
+		}
+		for i, key := range keys {
+			obj, err := client.CopyObject(ctx, key, newKeys[i])
+			if err != nil {
+				return err
+			}
+			cache.AddObject(obj)
+		}
+		cache.AddDir(newName)
+		if err := client.RemoveObjects(ctx, keys); err != nil {
+			return err
+		}
+	} else if _, ok := cache.GetFile(oldName); ok {
+		obj, err := client.CopyObject(ctx, oldName, newName)
+		if err != nil {
+			return err
+		}
+		cache.AddObject(obj)
+		if err := client.RemoveObject(ctx, oldName); err != nil {
+			return err
+		}
+	} else {
+		return os.ErrNotExist
+	}
+
+	cache.Remove(oldName)
+	return nil
+}
+
+// keysUnder lists the keys of all objects in the directory `dirPath`, from S3 rather than from the cache.
+func keysUnder(ctx context.Context, client S3Client, dirPath string) ([]string, error) {
+	keys := []string{}
+	err := client.ForEachObjectIn(ctx, strings.TrimLeft(dirPath, "/")+"/", func(obj minio.ObjectInfo) {
+		keys = append(keys, obj.Key)
+	})
+	return keys, err
+}
+
+// csrfToken returns the token the HTML forms must send back.
+// It is bound to the credentials of the request, so a token seen by
+// someone else (or anonymously) is useless, and changes on restart.
+func (b *S3Browser) csrfToken(r *http.Request) string {
+	mac := hmac.New(sha256.New, b.csrfKey)
+	mac.Write([]byte(r.Header.Get("Authorization")))
+	mac.Write([]byte{0})
+	mac.Write([]byte(requestUser(r)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkCSRF rejects cross-site requests.
+// JSON requests cannot be sent cross-site without a CORS preflight, which is never allowed,
+// HTML forms must include the token from csrfToken, scripts send it in the X-CSRF-Token header.
+func (b *S3Browser) checkCSRF(r *http.Request, isJSON bool) error {
+	if err := checkOrigin(r); err != nil {
+		return err
+	}
+	if isJSON {
+		return nil
+	}
+
+	token := r.Header.Get("X-CSRF-Token")
+	// Multipart bodies are files being uploaded, reading the form would buffer them
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); token == "" && mediaType != "multipart/form-data" {
+		token = r.PostFormValue("csrf")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(b.csrfToken(r))) != 1 {
+		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("invalid CSRF token"))
+	}
+	return nil
+}
+
+// checkOrigin rejects requests sent by the browser from another site.
+// It is also checked before asking for credentials, so other sites can't make browsers prompt for them.
+func checkOrigin(r *http.Request) error {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("cross-origin request from %q", origin))
+		}
+	}
+	return nil
+}
+
+// serveManage handles the `?manage` requests:
+//   - GET <dir>?manage=login: ask for credentials, then go back to the listing
+//   - POST <path>?manage=delete: delete a file, or a folder recursively
+//   - POST <path>?manage=rename: rename or move to `to`
+//   - POST <dir>?manage=mkdir: create the folder `name`
+//
+// Parameters are sent as an HTML form (with the CSRF token) or as a JSON object.
+func (b *S3Browser) serveManage(w http.ResponseWriter, r *http.Request) error {
+	fullPath := normalizePath(r.URL.Path)
+	action := r.URL.Query().Get("manage")
+	login := action == manageLogin && r.Method == http.MethodGet
+
+	if !login && !b.Manage {
+		// Only logging in is needed to create share links
+		return caddyhttp.Error(http.StatusNotFound, nil)
+	}
+	if !login && r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return caddyhttp.Error(http.StatusMethodNotAllowed, nil)
+	}
+	if err := checkOrigin(r); err != nil {
+		return err
+	}
+	if !authorized(r, b.ManageSecret) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="s3browser"`)
+		return caddyhttp.Error(http.StatusUnauthorized, nil)
+	}
+
+	if login {
+		http.Redirect(w, r, (&url.URL{Path: fullPath}).EscapedPath(), http.StatusSeeOther)
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isJSON := mediaType == "application/json"
+	if err := b.checkCSRF(r, isJSON); err != nil {
+		return err
+	}
+
+	var req manageRequest
+	if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+	} else {
+		req.To = r.PostFormValue("to")
+		req.Name = r.PostFormValue("name")
+	}
+
+	client := *b.s3Client()
+	allowed := func(perm string, p string) bool {
+		return b.allowed(r, perm, p)
+	}
+	logFields := []zap.Field{
+		zap.String("path", fullPath),
+		zap.String("user", requestUser(r)),
+		zap.String("remote", r.RemoteAddr),
+	}
+
+	var resultPath string
+	var err error
+	switch action {
+	case manageDelete:
+		if !b.allowed(r, permDelete, fullPath) {
+			return b.denied(r, fullPath)
+		}
+		resultPath = fullPath
+		err = removePath(r.Context(), b.s3Cache, client, allowed, fullPath)
+		b.log.Info("delete", append(logFields, zap.Error(err))...)
+	case manageRename:
+		resultPath = req.To
+		if !strings.HasPrefix(resultPath, "/") {
+			if !validName(resultPath) {
+				return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid name: %q", resultPath))
+			}
+			resultPath = path.Join(path.Dir(fullPath), resultPath)
+		}
+		resultPath = normalizePath(resultPath)
+		if !b.allowed(r, permDelete, fullPath) {
+			return b.denied(r, fullPath)
+		}
+		if !b.allowed(r, permUpload, resultPath) {
+			return b.denied(r, resultPath)
+		}
+		if b.exists(resultPath) {
+			return caddyhttp.Error(http.StatusConflict, fmt.Errorf("already exists: %s", resultPath))
+		}
+		err = renamePath(r.Context(), b.s3Cache, client, allowed, fullPath, resultPath)
+		b.log.Info("rename", append(logFields, zap.String("to", resultPath), zap.Error(err))...)
+	case manageMkdir:
+		if !validName(req.Name) {
+			return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid name: %q", req.Name))
+		}
+		resultPath = path.Join(fullPath, req.Name)
+		if !b.allowed(r, permUpload, resultPath) {
+			return b.denied(r, resultPath)
+		}
+		err = makeDir(r.Context(), b.s3Cache, client, resultPath)
+		b.log.Info("mkdir", append(logFields, zap.String("name", req.Name), zap.Error(err))...)
+	default:
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid manage request"))
+	}
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return caddyhttp.Error(http.StatusNotFound, err)
+	case errors.Is(err, os.ErrExist):
+		return caddyhttp.Error(http.StatusConflict, err)
+	case errors.Is(err, os.ErrPermission):
+		return caddyhttp.Error(http.StatusForbidden, err)
+	case err != nil:
+		return err
+	}
+
+	if isJSON {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		return b.writeJSON(w, manageResponse{Path: resultPath})
+	}
+	// Back to the listing of the directory containing the result
+	http.Redirect(w, r, (&url.URL{Path: path.Dir(resultPath)}).EscapedPath(), http.StatusSeeOther)
+	return nil
+}
+
+func (b *S3Browser) exists(name string) bool {
+	_, isDir := b.s3Cache.GetDir(name)
+	_, isFile := b.s3Cache.GetFile(name)
+	return isDir || isFile
+}
+
+// validName checks `name` is a single path element.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
@@ -0,0 +1,121 @@
+package s3browser
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// newManageRequest returns a form request, or a JSON one when body starts with "{".
+func newManageRequest(method string, target string, body string) *http.Request {
+	r := httptest.NewRequest(method, "http://example.com"+target, strings.NewReader(body))
+	if strings.HasPrefix(body, "{") {
+		r.Header.Set("Content-Type", "application/json")
+	} else {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return r
+}
+
+func TestManageAuth(t *testing.T) {
+	b, f := newTestS3Browser(t, &S3Browser{Manage: true, ManageSecret: testManageSecret})
+
+	// The token of the form is bound to the credentials
+	login := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	login.SetBasicAuth("admin", testManageSecret)
+	token := b.csrfToken(login)
+	other := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	other.SetBasicAuth("admin", "other")
+	otherToken := b.csrfToken(other)
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		password string
+		origin   string
+		status   int // 0 for success
+	}{
+		{"GET", http.MethodGet, "/a.txt?manage=delete", "", testManageSecret, "", http.StatusMethodNotAllowed},
+		{"no credentials", http.MethodPost, "/a.txt?manage=delete", `{}`, "", "", http.StatusUnauthorized},
+		{"wrong credentials", http.MethodPost, "/a.txt?manage=delete", `{}`, "wrong", "", http.StatusUnauthorized},
+		{"other origin", http.MethodPost, "/a.txt?manage=delete", `{}`, testManageSecret, "https://evil.example", http.StatusForbidden},
+		{"other origin without credentials", http.MethodPost, "/a.txt?manage=delete", `{}`, "", "https://evil.example", http.StatusForbidden},
+		{"form without CSRF token", http.MethodPost, "/a.txt?manage=delete", "", testManageSecret, "", http.StatusForbidden},
+		{"form with a wrong CSRF token", http.MethodPost, "/a.txt?manage=delete", "csrf=0123", testManageSecret, "", http.StatusForbidden},
+		{"form with the token of other credentials", http.MethodPost, "/a.txt?manage=delete", "csrf=" + otherToken, testManageSecret, "", http.StatusForbidden},
+		{"unknown action", http.MethodPost, "/a.txt?manage=chmod", `{}`, testManageSecret, "", http.StatusBadRequest},
+		{"invalid name", http.MethodPost, "/docs/?manage=mkdir", `{"name":"../x"}`, testManageSecret, "", http.StatusBadRequest},
+		{"existing target", http.MethodPost, "/a.txt?manage=rename", `{"to":"b.txt"}`, testManageSecret, "", http.StatusConflict},
+		{"delete", http.MethodPost, "/a.txt?manage=delete", "csrf=" + token, testManageSecret, "", 0},
+		{"rename", http.MethodPost, "/b.txt?manage=rename", "to=c.txt&csrf=" + url.QueryEscape(token), testManageSecret, "http://example.com", 0},
+		{"mkdir", http.MethodPost, "/docs/?manage=mkdir", `{"name":"new"}`, testManageSecret, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newManageRequest(tt.method, tt.target, tt.body)
+			if tt.password != "" {
+				r.SetBasicAuth("admin", tt.password)
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			w, err := serve(b, r)
+			if tt.status == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if w.Code >= 400 {
+					t.Errorf("status %d", w.Code)
+				}
+				return
+			}
+			if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != tt.status {
+				t.Errorf("got %v, want a %d error", err, tt.status)
+			}
+		})
+	}
+
+	for key, want := range map[string]bool{"a.txt": false, "b.txt": false, "c.txt": true, "docs/new/": true} {
+		if _, ok := f.object(key); ok != want {
+			t.Errorf("%s: exists %v, want %v", key, ok, want)
+		}
+	}
+	if data, _ := f.object("c.txt"); string(data) != "0123456789" {
+		t.Errorf("renamed to %q", data)
+	}
+}
+
+func TestManageDisabled(t *testing.T) {
+	// Sharing needs the login
+	b, f := newTestS3Browser(t, &S3Browser{Share: true, ManageSecret: testManageSecret})
+
+	r := newManageRequest(http.MethodPost, "/a.txt?manage=delete", `{}`)
+	r.SetBasicAuth("admin", testManageSecret)
+	_, err := serve(b, r)
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusNotFound {
+		t.Errorf("got %v, want a 404 error", err)
+	}
+	if _, ok := f.object("a.txt"); !ok {
+		t.Error("deleted")
+	}
+
+	// Logging in is still possible
+	r = httptest.NewRequest(http.MethodGet, "http://example.com/docs/?manage=login", nil)
+	if _, err := serve(b, r); err == nil {
+		t.Error("logged in without credentials")
+	}
+	r.SetBasicAuth("admin", testManageSecret)
+	w, err := serve(b, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/docs" {
+		t.Errorf("got %d to %q, want a redirection to the listing", w.Code, w.Header().Get("Location"))
+	}
+}
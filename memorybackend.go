@@ -0,0 +1,115 @@
+package s3browser
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// MemoryBackend keeps the objects in memory, it starts empty.
+// It is meant for tests and demos, everything is lost on restart.
+type MemoryBackend struct {
+	lock    sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	info minio.ObjectInfo
+	data []byte
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{objects: map[string]memoryObject{}}
+}
+
+func (mb *MemoryBackend) ForEachObjectIn(ctx context.Context, prefix string, fn func(minio.ObjectInfo)) error {
+	mb.lock.RLock()
+	infos := []minio.ObjectInfo{}
+	for key, obj := range mb.objects {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, obj.info)
+		}
+	}
+	mb.lock.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Key < infos[j].Key
+	})
+	for _, info := range infos {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fn(info)
+	}
+	return nil
+}
+
+func (mb *MemoryBackend) StatObject(ctx context.Context, filePath string) (minio.ObjectInfo, error) {
+	key := strings.TrimLeft(filePath, "/")
+	mb.lock.RLock()
+	defer mb.lock.RUnlock()
+	obj, ok := mb.objects[key]
+	if !ok {
+		return minio.ObjectInfo{}, noSuchKey(key)
+	}
+	return obj.info, nil
+}
+
+func (mb *MemoryBackend) GetObject(ctx context.Context, filePath string, rangeHdr string) (io.ReadCloser, minio.ObjectInfo, http.Header, error) {
+	key := strings.TrimLeft(filePath, "/")
+	mb.lock.RLock()
+	obj, ok := mb.objects[key]
+	mb.lock.RUnlock()
+	if !ok {
+		return nil, minio.ObjectInfo{}, nil, noSuchKey(key)
+	}
+	// The data is never modified, a new object replaces it
+	reader, headers, err := readObject(bytes.NewReader(obj.data), obj.info, rangeHdr)
+	if err != nil {
+		return nil, obj.info, nil, err
+	}
+	return ioutil.NopCloser(reader), obj.info, headers, nil
+}
+
+func (mb *MemoryBackend) PresignedGetObject(ctx context.Context, filePath string, expiry time.Duration, params url.Values) (*url.URL, error) {
+	return nil, errPresignUnsupported
+}
+
+// PutObject stores the object with the MD5 ETag S3 gives to single part uploads.
+func (mb *MemoryBackend) PutObject(ctx context.Context, filePath string, reader io.Reader, size int64, contentType string) (minio.ObjectInfo, error) {
+	key := strings.TrimLeft(filePath, "/")
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	if contentType == "" {
+		contentType = mimeType(key)
+	}
+	sum := md5.Sum(data)
+	obj := memoryObject{
+		info: minio.ObjectInfo{
+			Key:          key,
+			Size:         int64(len(data)),
+			LastModified: time.Now().UTC(),
+			ETag:         hex.EncodeToString(sum[:]),
+			ContentType:  contentType,
+		},
+		data: data,
+	}
+
+	mb.lock.Lock()
+	mb.objects[key] = obj
+	mb.lock.Unlock()
+	return obj.info, nil
+}
@@ -0,0 +1,95 @@
+package s3browser
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestMemoryBackendListing(t *testing.T) {
+	b := newTestBrowser(t, &S3Browser{})
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/photos/2023/", nil)
+	w, err := serve(b, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type: %q", ct)
+	}
+	body := w.Body.String()
+	for _, name := range []string{"cat.jpg", "dog.jpeg"} {
+		if !strings.Contains(body, name) {
+			t.Errorf("%s is not listed", name)
+		}
+	}
+	if strings.Contains(body, "guide.txt") {
+		t.Error("a file of another folder is listed")
+	}
+}
+
+// Unknown paths are passed to the next handler, which answers 418 in the tests.
+func TestMemoryBackendNextHandler(t *testing.T) {
+	b := newTestBrowser(t, &S3Browser{})
+
+	for _, target := range []string{"/missing.txt", "/docs/missing/", "/docs/api/v3.json"} {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com"+target, nil)
+		_, err := serve(b, r)
+		if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusTeapot {
+			t.Errorf("%s: got %v, want the next handler", target, err)
+		}
+	}
+}
+
+func TestMemoryBackendDownload(t *testing.T) {
+	b := newTestBrowser(t, &S3Browser{})
+
+	tests := []struct {
+		name         string
+		rangeHdr     string
+		status       int
+		body         string
+		contentRange string
+	}{
+		{"whole", "", http.StatusOK, "0123456789", ""},
+		{"range", "bytes=2-5", http.StatusPartialContent, "2345", "bytes 2-5/10"},
+		{"open range", "bytes=7-", http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"suffix", "bytes=-3", http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"multi-range ignored", "bytes=0-1,4-5", http.StatusOK, "0123456789", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/b.txt", nil)
+			if tt.rangeHdr != "" {
+				r.Header.Set("Range", tt.rangeHdr)
+			}
+			w, err := serve(b, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tt.status {
+				t.Errorf("status: got %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Body.String(); got != tt.body {
+				t.Errorf("body: got %q, want %q", got, tt.body)
+			}
+			if got := w.Header().Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("Content-Range: got %q, want %q", got, tt.contentRange)
+			}
+		})
+	}
+}
+
+func TestMemoryBackendUnsatisfiableRange(t *testing.T) {
+	b := newTestBrowser(t, &S3Browser{})
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/b.txt", nil)
+	r.Header.Set("Range", "bytes=10-")
+	_, err := serve(b, r)
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("got %v, want a 416 error", err)
+	}
+}
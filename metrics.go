@@ -0,0 +1,147 @@
+package s3browser
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Values for the "method" label of downloads_total
+const (
+	downloadProxied    = "proxy"
+	downloadRedirected = "redirect"
+)
+
+// The metrics are registered in the default registry, like Caddy's,
+// so they are exposed by the /metrics endpoint of the admin API or the metrics handler.
+var s3browserMetrics = struct {
+	init            sync.Once
+	refreshDuration *prometheus.HistogramVec
+	refreshErrors   *prometheus.CounterVec
+	refreshObjects  *prometheus.GaugeVec
+	cacheDirs       *prometheus.GaugeVec
+	cacheFiles      *prometheus.GaugeVec
+	cacheBytes      *prometheus.GaugeVec
+	s3Duration      *prometheus.HistogramVec
+	s3Errors        *prometheus.CounterVec
+	s3Requests      *prometheus.CounterVec
+	servedBytes     *prometheus.CounterVec
+	downloads       *prometheus.CounterVec
+	renderDuration  *prometheus.HistogramVec
+}{
+	init: sync.Once{},
+}
+
+func initMetrics() {
+	const ns, sub = "caddy", "s3browser"
+
+	bucketLabels := []string{"bucket"}
+	s3browserMetrics.refreshDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "refresh_duration_seconds",
+		Help:      "Histogram of the durations of the cache refreshes.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, bucketLabels)
+	s3browserMetrics.refreshErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "refresh_errors_total",
+		Help:      "Number of failed cache refreshes.",
+	}, bucketLabels)
+	s3browserMetrics.refreshObjects = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "refresh_objects",
+		Help:      "Number of objects listed by the last successful full refresh.",
+	}, bucketLabels)
+	s3browserMetrics.cacheDirs = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "cache_dirs",
+		Help:      "Number of directories in the cache, as of the last refresh.",
+	}, bucketLabels)
+	s3browserMetrics.cacheFiles = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "cache_files",
+		Help:      "Number of files in the cache, as of the last refresh.",
+	}, bucketLabels)
+	s3browserMetrics.cacheBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "cache_bytes",
+		Help:      "Total size of the files in the cache, as of the last refresh.",
+	}, bucketLabels)
+
+	s3Labels := []string{"bucket", "operation"}
+	s3browserMetrics.s3Duration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "s3_request_duration_seconds",
+		Help:      "Histogram of the durations of S3 requests, until the response headers for downloads.",
+		Buckets:   prometheus.DefBuckets,
+	}, s3Labels)
+	s3browserMetrics.s3Errors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "s3_request_errors_total",
+		Help:      "Number of failed S3 requests.",
+	}, s3Labels)
+	s3browserMetrics.s3Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "s3_requests_total",
+		Help:      "Estimated number of billed S3 requests by pricing tier, including retries and the downloads redirected to presigned URLs.",
+	}, []string{"bucket", "tier"})
+
+	s3browserMetrics.servedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "served_bytes_total",
+		Help:      "Bytes of files proxied from S3 to the clients.",
+	}, bucketLabels)
+	s3browserMetrics.downloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "downloads_total",
+		Help:      "Number of file downloads, proxied or redirected to a presigned URL.",
+	}, []string{"bucket", "method"})
+	s3browserMetrics.renderDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "listing_render_duration_seconds",
+		Help:      "Histogram of the durations of directory listings.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"bucket", "format"})
+}
+
+// observeRefresh records a refresh, `objects` is only used for full refreshes.
+func observeRefresh(bucket string, prefix string, duration time.Duration, objects int, err error) {
+	s3browserMetrics.refreshDuration.WithLabelValues(bucket).Observe(duration.Seconds())
+	if err != nil {
+		s3browserMetrics.refreshErrors.WithLabelValues(bucket).Inc()
+	} else if prefix == "/" {
+		s3browserMetrics.refreshObjects.WithLabelValues(bucket).Set(float64(objects))
+	}
+}
+
+func observeCacheSize(bucket string, dirs int, files int, bytes int64) {
+	s3browserMetrics.cacheDirs.WithLabelValues(bucket).Set(float64(dirs))
+	s3browserMetrics.cacheFiles.WithLabelValues(bucket).Set(float64(files))
+	s3browserMetrics.cacheBytes.WithLabelValues(bucket).Set(float64(bytes))
+}
+
+func observeRender(bucket string, format string, start time.Time) {
+	s3browserMetrics.renderDuration.WithLabelValues(bucket, format).Observe(time.Since(start).Seconds())
+}
+
+// observeS3 records an S3 request started at `start`, it is deferred with the named error result of the caller.
+func observeS3(bucket string, operation string, start time.Time, err *error) {
+	s3browserMetrics.s3Duration.WithLabelValues(bucket, operation).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		s3browserMetrics.s3Errors.WithLabelValues(bucket, operation).Inc()
+	}
+}
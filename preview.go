@@ -0,0 +1,166 @@
+package s3browser
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+)
+
+// defaultPreviewMaxSize is used when preview_max_size is not set.
+const defaultPreviewMaxSize = 1 << 20 // 1 MiB
+
+// Values for PreviewArgs.Kind
+const (
+	previewNone     = "none"
+	previewText     = "text"
+	previewMarkdown = "markdown"
+	previewImage    = "image"
+	previewVideo    = "video"
+	previewAudio    = "audio"
+	previewPDF      = "pdf"
+)
+
+type PreviewArgs struct {
+	TemplateArgs
+	Name      string
+	Link      string // URL of the raw file
+	File      File
+	Kind      string
+	Content   template.HTML // rendered text/markdown, empty for other kinds
+	Truncated bool          // Content only shows the beginning of the file
+}
+
+var codeFormatter = chromahtml.New(
+	chromahtml.WithLineNumbers(true),
+	chromahtml.TabWidth(4),
+)
+
+// previewKind returns how the file `name` can be previewed.
+func previewKind(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	switch ext {
+	case ".md", ".markdown":
+		return previewMarkdown
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp", ".svg", ".bmp", ".ico", ".avif":
+		return previewImage
+	case ".mp4", ".m4v", ".webm", ".ogv", ".mov":
+		return previewVideo
+	case ".mp3", ".m4a", ".ogg", ".oga", ".opus", ".wav", ".flac":
+		return previewAudio
+	case ".pdf":
+		return previewPDF
+	}
+
+	if lexers.Match(name) != nil {
+		return previewText
+	}
+	if mimeType := mime.TypeByExtension(ext); strings.HasPrefix(mimeType, "text/") {
+		return previewText
+	}
+	return previewNone
+}
+
+func (b *S3Browser) servePreview(w http.ResponseWriter, r *http.Request, filePath string, file File) (err error) {
+	ctx, span := startSpan(r.Context(), "s3browser.preview", attrPath.String(filePath))
+	defer endSpan(span, &err)
+
+	dirPath, name := path.Split(filePath)
+	dir, _ := b.s3Cache.GetDir(dirPath)
+
+	args := PreviewArgs{
+		TemplateArgs: TemplateArgs{
+			SiteName: b.SiteName,
+			Dir:      dir,
+		},
+		Name: name,
+		Link: filePath,
+		File: file,
+		Kind: previewKind(name),
+	}
+
+	if args.Kind == previewText || args.Kind == previewMarkdown {
+		content, truncated, err := b.fetchPreview(ctx, filePath)
+		if err != nil {
+			return err
+		}
+		args.Truncated = truncated
+
+		if !utf8.Valid(content) {
+			// Binary file with a text-like name
+			args.Kind = previewNone
+		} else if args.Kind == previewMarkdown {
+			args.Content = renderReadme(name, content)
+		} else {
+			args.Content = highlight(name, content)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return b.template.ExecuteTemplate(w, "preview", args)
+}
+
+// fetchPreview returns at most PreviewMaxSize bytes of the file.
+func (b *S3Browser) fetchPreview(ctx context.Context, filePath string) ([]byte, bool, error) {
+	maxSize := b.PreviewMaxSize
+	if maxSize <= 0 {
+		maxSize = defaultPreviewMaxSize
+	}
+
+	reader, _, _, err := b.store.GetObject(ctx, filePath, "")
+	if err != nil {
+		return nil, false, err
+	}
+	defer reader.Close()
+
+	// Read one more byte to know if the file was truncated
+	content, err := ioutil.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(content)) <= maxSize {
+		return content, false, nil
+	}
+
+	content = content[:maxSize]
+	// Do not cut an UTF-8 sequence in half
+	for i := 0; i < utf8.UTFMax && len(content) > 0 && !utf8.Valid(content); i++ {
+		content = content[:len(content)-1]
+	}
+	return content, true, nil
+}
+
+// highlight returns `content` as syntax highlighted HTML, the language
+// is detected from the file name, or the content itself.
+func highlight(name string, content []byte) template.HTML {
+	lexer := lexers.Match(name)
+	if lexer == nil {
+		lexer = lexers.Analyse(string(content))
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	lexer = chroma.Coalesce(lexer)
+
+	iterator, err := lexer.Tokenise(nil, string(content))
+	if err != nil {
+		return preformatted(content)
+	}
+
+	var buf bytes.Buffer
+	if err := codeFormatter.Format(&buf, styles.Get("github"), iterator); err != nil {
+		return preformatted(content)
+	}
+	return template.HTML(buf.String())
+}
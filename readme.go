@@ -0,0 +1,152 @@
+package s3browser
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer/html"
+	"go.uber.org/zap"
+)
+
+// defaultReadmeMaxSize is used when readme_max_size is not set.
+const defaultReadmeMaxSize = 1 << 20 // 1 MiB
+
+// ReadmeCache holds the rendered HEADER/README files, keyed by their full path and ETag.
+// The entries of a directory are dropped when it is refreshed, see Drop.
+type ReadmeCache struct {
+	lock    sync.Mutex
+	backend Backend
+	maxSize int64
+	logger  *zap.Logger
+	entries map[readmeKey]template.HTML
+}
+
+type readmeKey struct {
+	path string
+	etag string
+}
+
+var (
+	markdown = goldmark.New(
+		goldmark.WithExtensions(extension.GFM),
+		goldmark.WithRendererOptions(html.WithUnsafe()), // output is sanitized below
+	)
+	sanitizer = bluemonday.UGCPolicy()
+)
+
+func NewReadmeCache(backend Backend, maxSize int64, l *zap.Logger) *ReadmeCache {
+	if maxSize <= 0 {
+		maxSize = defaultReadmeMaxSize
+	}
+	return &ReadmeCache{
+		backend: backend,
+		maxSize: maxSize,
+		logger:  l,
+		entries: map[readmeKey]template.HTML{},
+	}
+}
+
+// Render returns the first file of `names` listed in `dir`, rendered to sanitized HTML.
+// Only the listed names are looked at: files hidden with hide_listing_only are still
+// in the cache but must not be displayed.
+// Errors are logged and an empty string is returned, a missing README must never
+// prevent the listing from being displayed.
+func (rc *ReadmeCache) Render(ctx context.Context, dir Directory, names []string) template.HTML {
+	for _, name := range names {
+		if !listed(dir, name) {
+			continue
+		}
+		file := dir.GetFile(name)
+		if file.Bytes > rc.maxSize {
+			rc.logger.Debug("readme too large", zap.String("dir", dir.Path), zap.String("name", name))
+			continue
+		}
+		return rc.get(ctx, path.Join(dir.Path, name), file)
+	}
+	return ""
+}
+
+// listed reports whether `name` is one of the files listed in `dir`.
+func listed(dir Directory, name string) bool {
+	for _, filename := range dir.Filenames {
+		if filename == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (rc *ReadmeCache) get(ctx context.Context, filePath string, file File) template.HTML {
+	key := readmeKey{path: filePath, etag: file.ETag}
+	rc.lock.Lock()
+	rendered, ok := rc.entries[key]
+	rc.lock.Unlock()
+	if ok {
+		return rendered
+	}
+
+	content, err := rc.fetch(ctx, filePath)
+	if err != nil {
+		rc.logger.Warn("could not fetch readme", zap.String("path", filePath), zap.Error(err))
+		return ""
+	}
+
+	rendered = renderReadme(filePath, content)
+
+	rc.lock.Lock()
+	rc.entries[key] = rendered
+	rc.lock.Unlock()
+
+	return rendered
+}
+
+// Drop removes the entries of the files in `dirPath` and its subdirectories.
+func (rc *ReadmeCache) Drop(dirPath string) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	for key := range rc.entries {
+		if isUnder(key.path, dirPath) {
+			delete(rc.entries, key)
+		}
+	}
+}
+
+func (rc *ReadmeCache) fetch(ctx context.Context, filePath string) ([]byte, error) {
+	reader, _, _, err := rc.backend.GetObject(ctx, filePath, "")
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(&io.LimitedReader{R: reader, N: rc.maxSize})
+}
+
+// renderReadme converts `content` to HTML depending on the file extension:
+// Markdown is rendered, HTML is sanitized and anything else is shown as-is.
+func renderReadme(filePath string, content []byte) template.HTML {
+	switch strings.ToLower(path.Ext(filePath)) {
+	case ".md", ".markdown":
+		var buf bytes.Buffer
+		if err := markdown.Convert(content, &buf); err != nil {
+			return preformatted(content)
+		}
+		return template.HTML(sanitizer.SanitizeBytes(buf.Bytes()))
+	case ".html", ".htm":
+		return template.HTML(sanitizer.SanitizeBytes(content))
+	default:
+		return preformatted(content)
+	}
+}
+
+func preformatted(content []byte) template.HTML {
+	return template.HTML("<pre>" + template.HTMLEscapeString(string(content)) + "</pre>")
+}
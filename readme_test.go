@@ -0,0 +1,33 @@
+package s3browser
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadmeHidden(t *testing.T) {
+	tests := []struct {
+		name string
+		b    *S3Browser
+		want bool
+	}{
+		{"listed", &S3Browser{ReadmeFiles: []string{"README.md"}}, true},
+		{"hidden", &S3Browser{ReadmeFiles: []string{"README.md"}, Hide: []string{"README.md"}}, false},
+		{"hidden from the listing only", &S3Browser{ReadmeFiles: []string{"README.md"}, Hide: []string{"README.md"}, HideListingOnly: true}, false},
+		{"header hidden from the listing only", &S3Browser{HeaderFiles: []string{"README.md"}, Hide: []string{"README.md"}, HideListingOnly: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBrowser(t, tt.b)
+			w, err := serve(b, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := bytes.Contains(w.Body.Bytes(), []byte(">Test bucket</h1>")); got != tt.want {
+				t.Errorf("rendered: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
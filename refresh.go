@@ -0,0 +1,379 @@
+package s3browser
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// defaultRefreshInterval is the time between periodic refreshes.
+const defaultRefreshInterval = 5 * time.Minute
+
+// refreshRetryInterval is the longest time before retrying a failed full refresh.
+const refreshRetryInterval = 30 * time.Second
+
+// refreshHistorySize is the number of refreshes kept for the status.
+const refreshHistorySize = 20
+
+// maxSignatureAge is how old an HMAC-signed request can be, to limit replays.
+const maxSignatureAge = 5 * time.Minute
+
+// signatureHeader holds the HMAC signature of refresh API requests: "t=<unix time>,sig=<hex>"
+const signatureHeader = "X-S3Browser-Signature"
+
+// Values for RefreshResult.Source
+const (
+	refreshSourceProvision = "provision"
+	refreshSourceTimer     = "timer"
+	refreshSourceAPI       = "api"
+)
+
+// RefreshResult describes a finished refresh.
+type RefreshResult struct {
+	Prefix   string        `json:"prefix"`
+	Source   string        `json:"source"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration_ns"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// RefreshStatus is returned by `?refresh=status`.
+type RefreshStatus struct {
+	Running     bool            `json:"running"`
+	Pending     []string        `json:"pending"`
+	LastSuccess *time.Time      `json:"last_success,omitempty"`
+	Dirs        int             `json:"dirs"`
+	Files       int             `json:"files"`
+	Bytes       int64           `json:"bytes"`
+	History     []RefreshResult `json:"history"`
+}
+
+// refreshBatch groups the prefixes requested while a refresh is running, they are refreshed together.
+type refreshBatch struct {
+	prefixes map[string]string // prefix -> source
+	done     chan struct{}     // closed once `results` is set
+	results  []RefreshResult
+}
+
+// Refresher runs the refreshes of the S3FsCache, one at a time.
+// Triggers never block: requests made while a refresh is running are coalesced into the next one.
+type Refresher struct {
+	cache    *S3FsCache
+	interval time.Duration
+	logger   *zap.Logger
+	wake     chan struct{}
+
+	lock        sync.Mutex
+	pending     *refreshBatch
+	running     bool
+	lastSuccess time.Time
+	lastFailed  bool            // whether the last full refresh failed
+	history     []RefreshResult // most recent first
+}
+
+func newRefreshBatch() *refreshBatch {
+	return &refreshBatch{prefixes: map[string]string{}, done: make(chan struct{})}
+}
+
+func NewRefresher(cache *S3FsCache, interval time.Duration, l *zap.Logger) *Refresher {
+	if interval <= 0 {
+		interval = defaultRefreshInterval
+	}
+	return &Refresher{
+		cache:    cache,
+		interval: interval,
+		logger:   l,
+		wake:     make(chan struct{}, 1),
+		pending:  newRefreshBatch(),
+	}
+}
+
+// Trigger requests a refresh of `prefix` ("/" for everything).
+// The `done` channel of the returned batch is closed once it was refreshed.
+func (rf *Refresher) Trigger(prefix string, source string) *refreshBatch {
+	rf.lock.Lock()
+	batch := rf.pending
+	batch.prefixes[normalizePath(prefix)] = source
+	rf.lock.Unlock()
+
+	select {
+	case rf.wake <- struct{}{}:
+	default: // already woken up
+	}
+	return batch
+}
+
+// Run refreshes the cache when triggered and every `interval`, until `ctx` is done.
+// Failed full refreshes are retried sooner.
+func (rf *Refresher) Run(ctx context.Context) {
+	timer := time.NewTimer(rf.nextDelay())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-rf.wake:
+		case <-timer.C:
+			rf.Trigger("/", refreshSourceTimer)
+			continue
+		}
+
+		rf.lock.Lock()
+		batch := rf.pending
+		rf.pending = newRefreshBatch()
+		rf.running = true
+		rf.lock.Unlock()
+
+		batch.results = rf.runBatch(ctx, batch)
+		close(batch.done)
+
+		rf.lock.Lock()
+		rf.running = false
+		rf.lock.Unlock()
+
+		if _, ok := batch.prefixes["/"]; ok {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(rf.nextDelay())
+		}
+	}
+}
+
+// nextDelay returns the time until the next periodic refresh.
+func (rf *Refresher) nextDelay() time.Duration {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.lastFailed && rf.interval > refreshRetryInterval {
+		return refreshRetryInterval
+	}
+	return rf.interval
+}
+
+// runBatch refreshes the prefixes of `batch`, skipping the ones covered by another one.
+func (rf *Refresher) runBatch(ctx context.Context, batch *refreshBatch) []RefreshResult {
+	prefixes := make([]string, 0, len(batch.prefixes))
+	for prefix := range batch.prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes) // parents first
+
+	results := []RefreshResult{}
+	done := []string{}
+next:
+	for _, prefix := range prefixes {
+		for _, parent := range done {
+			if isUnder(prefix, parent) {
+				continue next
+			}
+		}
+		done = append(done, prefix)
+		results = append(results, rf.Refresh(ctx, prefix, batch.prefixes[prefix]))
+	}
+	return results
+}
+
+// Refresh refreshes `prefix` right away and records the result.
+// Everything is refreshed while the cache is not loaded.
+func (rf *Refresher) Refresh(ctx context.Context, prefix string, source string) RefreshResult {
+	if prefix != "/" && !rf.cache.Loaded() {
+		prefix = "/"
+	}
+	rf.logger.Debug("refresh", zap.String("source", source), zap.String("prefix", prefix))
+
+	ctx, span := startSpan(ctx, "s3browser.refresh",
+		attrBucket.String(rf.cache.bucket), attrPrefix.String(prefix), attribute.String("s3browser.source", source))
+	result := RefreshResult{Prefix: prefix, Source: source, Started: time.Now()}
+	objects, err := rf.cache.RefreshPrefix(ctx, prefix)
+	result.Duration = time.Since(result.Started)
+	span.SetAttributes(attribute.Int("s3.objects", objects))
+	endSpan(span, &err)
+	if err != nil {
+		rf.logger.Error("Could not refresh", zap.String("prefix", prefix), zap.Error(err))
+		result.Error = err.Error()
+	}
+	observeRefresh(rf.cache.bucket, prefix, result.Duration, objects, err)
+	dirs, files, bytes := rf.cache.Stats()
+	observeCacheSize(rf.cache.bucket, dirs, files, bytes)
+
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if prefix == "/" {
+		rf.lastFailed = err != nil
+		if err == nil {
+			rf.lastSuccess = result.Started
+		}
+	}
+	rf.history = append([]RefreshResult{result}, rf.history...)
+	if len(rf.history) > refreshHistorySize {
+		rf.history = rf.history[:refreshHistorySize]
+	}
+	return result
+}
+
+// LastSuccess returns the start of the last successful full refresh, zero if none.
+func (rf *Refresher) LastSuccess() time.Time {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	return rf.lastSuccess
+}
+
+func (rf *Refresher) Status() RefreshStatus {
+	rf.lock.Lock()
+	status := RefreshStatus{
+		Running: rf.running,
+		Pending: []string{},
+		History: append([]RefreshResult{}, rf.history...),
+	}
+	for prefix := range rf.pending.prefixes {
+		status.Pending = append(status.Pending, prefix)
+	}
+	if !rf.lastSuccess.IsZero() {
+		lastSuccess := rf.lastSuccess
+		status.LastSuccess = &lastSuccess
+	}
+	rf.lock.Unlock()
+
+	sort.Strings(status.Pending)
+	status.Dirs, status.Files, status.Bytes = rf.cache.Stats()
+	return status
+}
+
+// refreshAuthorized checks the credentials of refresh API requests, any of:
+//   - a bearer token from refresh_api_tokens
+//   - refresh_api_secret as the basic auth password (the user name is ignored)
+//   - an HMAC-SHA256 signature made with refresh_api_secret, see requestSignature
+//
+// Everyone is allowed when neither is configured.
+func (b *S3Browser) refreshAuthorized(r *http.Request) bool {
+	if b.RefreshAPISecret == "" && len(b.RefreshAPITokens) == 0 {
+		return true
+	}
+
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		for _, valid := range b.RefreshAPITokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(valid)) == 1 {
+				return true
+			}
+		}
+		return false
+	}
+	if b.RefreshAPISecret == "" {
+		return false
+	}
+
+	if _, pwd, ok := r.BasicAuth(); ok {
+		return subtle.ConstantTimeCompare([]byte(pwd), []byte(b.RefreshAPISecret)) == 1
+	}
+
+	if sigHdr := r.Header.Get(signatureHeader); sigHdr != "" {
+		var timestamp, sig string
+		for _, part := range strings.Split(sigHdr, ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "t":
+				timestamp = kv[1]
+			case "sig":
+				sig = kv[1]
+			}
+		}
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return false
+		}
+		if age := time.Since(time.Unix(unix, 0)); age > maxSignatureAge || age < -maxSignatureAge {
+			return false
+		}
+		return hmac.Equal([]byte(sig), []byte(requestSignature(b.RefreshAPISecret, r.Method, r.URL.RequestURI(), timestamp)))
+	}
+	return false
+}
+
+// requestSignature returns the hex HMAC-SHA256 of "<method>\n<request URI>\n<unix time>".
+func requestSignature(secret, method, requestURI, timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s", method, requestURI, timestamp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type refreshError struct {
+	Error string `json:"error"`
+}
+
+// serveRefreshAPI handles:
+//   - POST <path> (without query): refresh everything, kept for compatibility
+//   - POST <prefix>?refresh[&wait=true]: refresh the directory, waiting for the end if asked
+//   - GET ?refresh=status: status and history of the refreshes
+func (b *S3Browser) serveRefreshAPI(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if !b.refreshAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="s3browser"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return b.writeJSON(w, refreshError{Error: "unauthorized"})
+	}
+
+	query := r.URL.Query()
+	if query.Get("refresh") == "status" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			return caddyhttp.Error(http.StatusMethodNotAllowed, nil)
+		}
+		return b.writeJSON(w, b.refresher.Status())
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return caddyhttp.Error(http.StatusMethodNotAllowed, nil)
+	}
+
+	prefix := "/"
+	if _, ok := query["refresh"]; ok {
+		prefix = normalizePath(r.URL.Path)
+	}
+	batch := b.refresher.Trigger(prefix, refreshSourceAPI)
+
+	if wait, _ := strconv.ParseBool(query.Get("wait")); !wait {
+		w.WriteHeader(http.StatusAccepted)
+		return b.writeJSON(w, map[string]string{"queued": prefix})
+	}
+
+	select {
+	case <-batch.done:
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+
+	// Only the refresh covering the prefix, others may have been coalesced
+	results := []RefreshResult{}
+	failed := false
+	for _, result := range batch.results {
+		if isUnder(prefix, result.Prefix) {
+			results = append(results, result)
+			failed = failed || result.Error != ""
+		}
+	}
+	if failed {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return b.writeJSON(w, results)
+}
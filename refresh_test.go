@@ -0,0 +1,73 @@
+package s3browser
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRefreshAuthorized(t *testing.T) {
+	const (
+		secret = "refresh secret"
+		target = "/docs/?refresh"
+	)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-maxSignatureAge-time.Minute).Unix(), 10)
+	future := strconv.FormatInt(time.Now().Add(maxSignatureAge+time.Minute).Unix(), 10)
+	signature := func(secret, method, uri, timestamp string) string {
+		return fmt.Sprintf("t=%s,sig=%s", timestamp, requestSignature(secret, method, uri, timestamp))
+	}
+
+	withSecret := &S3Browser{RefreshAPISecret: secret, RefreshAPITokens: []string{"token1", "token2"}}
+	tokensOnly := &S3Browser{RefreshAPITokens: []string{"token1"}}
+	open := &S3Browser{}
+
+	tests := []struct {
+		name   string
+		b      *S3Browser
+		method string
+		header string
+		value  string
+		basic  string
+		want   bool
+	}{
+		{"open", open, http.MethodPost, "", "", "", true},
+		{"nothing", withSecret, http.MethodPost, "", "", "", false},
+		// Bearer tokens
+		{"bearer", withSecret, http.MethodPost, "Authorization", "Bearer token2", "", true},
+		{"bearer tokens only", tokensOnly, http.MethodPost, "Authorization", "Bearer token1", "", true},
+		{"wrong bearer", withSecret, http.MethodPost, "Authorization", "Bearer token3", "", false},
+		{"bearer prefix", withSecret, http.MethodPost, "Authorization", "Bearer token", "", false},
+		{"secret as bearer", withSecret, http.MethodPost, "Authorization", "Bearer " + secret, "", false},
+		// Basic auth
+		{"basic", withSecret, http.MethodPost, "", "", secret, true},
+		{"wrong basic", withSecret, http.MethodPost, "", "", "wrong", false},
+		{"basic tokens only", tokensOnly, http.MethodPost, "", "", "token1", false},
+		// HMAC signatures
+		{"signature", withSecret, http.MethodPost, signatureHeader, signature(secret, http.MethodPost, target, now), "", true},
+		{"signature spaces", withSecret, http.MethodPost, signatureHeader, " t=" + now + ", sig=" + requestSignature(secret, http.MethodPost, target, now), "", true},
+		{"other secret", withSecret, http.MethodPost, signatureHeader, signature("other", http.MethodPost, target, now), "", false},
+		{"other method", withSecret, http.MethodGet, signatureHeader, signature(secret, http.MethodPost, target, now), "", false},
+		{"other path", withSecret, http.MethodPost, signatureHeader, signature(secret, http.MethodPost, "/?refresh", now), "", false},
+		{"expired", withSecret, http.MethodPost, signatureHeader, signature(secret, http.MethodPost, target, old), "", false},
+		{"future", withSecret, http.MethodPost, signatureHeader, signature(secret, http.MethodPost, target, future), "", false},
+		{"other timestamp", withSecret, http.MethodPost, signatureHeader, "t=" + old + ",sig=" + requestSignature(secret, http.MethodPost, target, now), "", false},
+		{"no timestamp", withSecret, http.MethodPost, signatureHeader, "sig=" + requestSignature(secret, http.MethodPost, target, now), "", false},
+		{"signature tokens only", tokensOnly, http.MethodPost, signatureHeader, signature("", http.MethodPost, target, now), "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "http://example.com"+target, nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		if tt.basic != "" {
+			r.SetBasicAuth("anyone", tt.basic)
+		}
+		if got := tt.b.refreshAuthorized(r); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,45 +1,315 @@
 package s3browser
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
-	"github.com/minio/minio-go/v6"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type S3Client struct {
-	s3     *minio.Client
-	bucket string
+	s3        *minio.Client
+	bucket    string
+	sse       *serverSideEncryption // nil without server-side encryption settings
+	transport *s3Transport
 }
 
-func NewS3Client(endpoint, key, secret string, secure bool, bucket string) (S3Client, error) {
-	minioClient, err := minio.New(endpoint, key, secret, secure)
+// NewS3Client makes a client for `bucket`, it keeps its connections and is meant to be shared.
+// The region of the bucket is looked up once when `region` is empty.
+func NewS3Client(endpoint, key, secret string, secure bool, bucket, region string) (S3Client, error) {
+	base, err := minio.DefaultTransport(secure)
+	if err != nil {
+		return S3Client{}, err
+	}
+	transport := &s3Transport{base: base, bucket: bucket, key: key, secret: secret}
+	minioClient, err := minio.New(endpoint, &minio.Options{
+		Creds:     credentials.NewStaticV4(key, secret, ""),
+		Secure:    secure,
+		Region:    region,
+		Transport: transport,
+	})
 	c := S3Client{
-		s3:     minioClient,
-		bucket: bucket,
+		s3:        minioClient,
+		bucket:    bucket,
+		transport: transport,
 	}
 	return c, err
 }
 
-func (c *S3Client) ForEachObject(fn func(minio.ObjectInfo)) error {
-	doneCh := make(chan struct{})
-	defer close(doneCh)
+// SetHeader adds `header` to every request to S3, including presigned URLs for their x-amz-* headers.
+func (c *S3Client) SetHeader(header http.Header) {
+	c.transport.header = header
+}
+
+// presignParams adds the x-amz-* extra headers to the query of a presigned URL,
+// the clients of presigned URLs can't send them.
+func (c *S3Client) presignParams(params url.Values) url.Values {
+	if c.transport == nil || len(c.transport.header) == 0 {
+		return params
+	}
+	withHeaders := url.Values{}
+	for name, values := range params {
+		withHeaders[name] = values
+	}
+	for name, values := range c.transport.header {
+		if isAmzHeader(name) {
+			withHeaders[strings.ToLower(name)] = values
+		}
+	}
+	return withHeaders
+}
+
+// uploadPartSize is the size of the parts of multipart uploads, each upload buffers one part in memory.
+// With at most 10000 parts, objects up to ~156GiB can be uploaded.
+const uploadPartSize = 16 << 20 // 16 MiB
+
+// ForEachObjectIn calls `fn` for every object whose key starts with `prefix`.
+// The listing stops when `ctx` is done, a partial listing is never returned without an error.
+func (c *S3Client) ForEachObjectIn(ctx context.Context, prefix string, fn func(minio.ObjectInfo)) error {
+	return c.listObjects(ctx, "ListObjectsV2", minio.ListObjectsOptions{Prefix: prefix, Recursive: true}, fn)
+}
+
+func (c *S3Client) listObjects(ctx context.Context, operation string, opts minio.ListObjectsOptions, fn func(minio.ObjectInfo)) (err error) {
+	ctx, span := startSpan(ctx, "s3."+operation, attrBucket.String(c.bucket), attrPrefix.String(opts.Prefix))
+	defer endSpan(span, &err)
+	defer observeS3(c.bucket, operation, time.Now(), &err)
 
-	objectCh := c.s3.ListObjectsV2(c.bucket, "", true, doneCh)
-	for object := range objectCh {
+	// The listing goroutine stops once ctx is done
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	objects := 0
+	for object := range c.s3.ListObjects(ctx, c.bucket, opts) {
 		if object.Err != nil {
 			return object.Err
 		}
+		objects++
 		fn(object)
 	}
-	return nil
+	span.SetAttributes(attribute.Int("s3.objects", objects))
+	// The channel is also closed when ctx is done
+	return ctx.Err()
+}
+
+func (c *S3Client) GetObject(ctx context.Context, filePath string, rangeHdr string) (_ io.ReadCloser, info minio.ObjectInfo, _ http.Header, err error) {
+	filePath = strings.TrimLeft(filePath, "/")
+	ctx, span := startSpan(ctx, "s3.GetObject", attrBucket.String(c.bucket), attrKey.String(filePath))
+	defer endSpan(span, &err)
+	defer observeS3(c.bucket, "GetObject", time.Now(), &err)
+
+	objectOptions := minio.GetObjectOptions{ServerSideEncryption: c.sse.customerKey(filePath)}
+	objectOptions.Set("Range", rangeHdr)
+	coreClient := minio.Core{Client: c.s3}
+	// The body is closed when ctx is done, e.g. when the client goes away
+	reader, info, headers, err := coreClient.GetObject(ctx, c.bucket, filePath, objectOptions)
+	span.SetAttributes(attrBytes.Int64(info.Size))
+	return reader, info, headers, err
+}
+
+// NewS3PresignClient returns a client only used to presign URLs. The region is given
+// so presigning never needs to reach `endpoint`, which may only be reachable by the clients.
+func NewS3PresignClient(endpoint, key, secret string, secure bool, bucket, region string) (S3Client, error) {
+	return NewS3Client(endpoint, key, secret, secure, bucket, region)
 }
 
-func (c *S3Client) GetObject(filePath string, rangeHdr string) (io.ReadCloser, minio.ObjectInfo, http.Header, error) {
+// PresignedGetObject returns a URL to download the object without credentials,
+// `params` can override response headers, e.g. "response-content-disposition".
+func (c *S3Client) PresignedGetObject(ctx context.Context, filePath string, expiry time.Duration, params url.Values) (_ *url.URL, err error) {
 	filePath = strings.TrimLeft(filePath, "/")
-	objectOptions := minio.GetObjectOptions{}
+	ctx, span := startSpan(ctx, "s3.PresignGetObject", attrBucket.String(c.bucket), attrKey.String(filePath))
+	defer endSpan(span, &err)
+	return c.s3.PresignedGetObject(ctx, c.bucket, filePath, expiry, c.presignParams(params))
+}
+
+// BucketExists checks that the bucket can be reached with the credentials, with a HeadBucket request.
+func (c *S3Client) BucketExists(ctx context.Context) (_ bool, err error) {
+	ctx, span := startSpan(ctx, "s3.HeadBucket", attrBucket.String(c.bucket))
+	defer endSpan(span, &err)
+	defer observeS3(c.bucket, "HeadBucket", time.Now(), &err)
+	return c.s3.BucketExists(ctx, c.bucket)
+}
+
+func (c *S3Client) StatObject(ctx context.Context, filePath string) (_ minio.ObjectInfo, err error) {
+	defer observeS3(c.bucket, "HeadObject", time.Now(), &err)
+	filePath = strings.TrimLeft(filePath, "/")
+	return c.s3.StatObject(ctx, c.bucket, filePath, minio.StatObjectOptions{ServerSideEncryption: c.sse.customerKey(filePath)})
+}
+
+// StoredSHA256 returns the SHA256 S3 stores with objects uploaded in one part with a checksum, in hex.
+// It is empty when the object has none, or only the checksum of its parts.
+func (c *S3Client) StoredSHA256(ctx context.Context, filePath string) (_ string, err error) {
+	defer observeS3(c.bucket, "HeadObject", time.Now(), &err)
+	filePath = strings.TrimLeft(filePath, "/")
+	info, err := c.s3.StatObject(ctx, c.bucket, filePath, minio.StatObjectOptions{
+		ServerSideEncryption: c.sse.customerKey(filePath),
+		Checksum:             true,
+	})
+	if err != nil || info.ChecksumMode == "COMPOSITE" {
+		return "", err
+	}
+	sum, decodeErr := base64.StdEncoding.DecodeString(info.ChecksumSHA256)
+	if decodeErr != nil || len(sum) != sha256.Size {
+		return "", nil // multipart checksums end with "-<parts>"
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// PutObject uploads `reader` without buffering it whole, `size` may be -1 if unknown.
+// The SHA256 of each part is sent so S3 checks their integrity.
+// It returns the info of the new object.
+func (c *S3Client) PutObject(ctx context.Context, filePath string, reader io.Reader, size int64, contentType string) (minio.ObjectInfo, error) {
+	key := strings.TrimLeft(filePath, "/")
+	if err := c.putObject(ctx, key, reader, size, contentType); err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	return c.StatObject(ctx, key)
+}
+
+func (c *S3Client) putObject(ctx context.Context, key string, reader io.Reader, size int64, contentType string) (err error) {
+	defer observeS3(c.bucket, "PutObject", time.Now(), &err)
+	_, err = c.s3.PutObject(ctx, c.bucket, key, reader, size, minio.PutObjectOptions{
+		ContentType:          contentType,
+		PartSize:             uploadPartSize,
+		ServerSideEncryption: c.sse.forUpload(key),
+		AutoChecksum:         minio.ChecksumSHA256,
+	})
+	return err
+}
+
+// CopyObject copies an object server-side, objects larger than 5GiB are copied in parts.
+func (c *S3Client) CopyObject(ctx context.Context, srcPath, dstPath string) (minio.ObjectInfo, error) {
+	srcKey := strings.TrimLeft(srcPath, "/")
+	dstKey := strings.TrimLeft(dstPath, "/")
+	if err := c.composeObject(ctx, srcKey, dstKey); err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	return c.StatObject(ctx, dstKey)
+}
+
+func (c *S3Client) composeObject(ctx context.Context, srcKey, dstKey string) (err error) {
+	defer observeS3(c.bucket, "CopyObject", time.Now(), &err)
+	dst := minio.CopyDestOptions{Bucket: c.bucket, Object: dstKey, Encryption: c.sse.forUpload(dstKey)}
+	src := minio.CopySrcOptions{Bucket: c.bucket, Object: srcKey, Encryption: c.sse.customerKey(srcKey)}
+	_, err = c.s3.ComposeObject(ctx, dst, src)
+	return err
+}
+
+func (c *S3Client) RemoveObject(ctx context.Context, filePath string) (err error) {
+	defer observeS3(c.bucket, "DeleteObject", time.Now(), &err)
+	return c.s3.RemoveObject(ctx, c.bucket, strings.TrimLeft(filePath, "/"), minio.RemoveObjectOptions{})
+}
+
+// RemoveObjects removes the objects with the given keys.
+func (c *S3Client) RemoveObjects(ctx context.Context, keys []string) (err error) {
+	defer observeS3(c.bucket, "DeleteObjects", time.Now(), &err)
+	objectsCh := make(chan minio.ObjectInfo, len(keys))
+	for _, key := range keys {
+		objectsCh <- minio.ObjectInfo{Key: key}
+	}
+	close(objectsCh)
+
+	for removeErr := range c.s3.RemoveObjects(ctx, c.bucket, objectsCh, minio.RemoveObjectsOptions{}) {
+		if err == nil { // the channel must be drained
+			err = fmt.Errorf("could not remove %s: %w", removeErr.ObjectName, removeErr.Err)
+		}
+	}
+	return err
+}
+
+// The following methods implement resumable uploads, the client sends each part separately.
+
+func (c *S3Client) NewMultipartUpload(ctx context.Context, filePath string, contentType string) (_ string, err error) {
+	defer observeS3(c.bucket, "CreateMultipartUpload", time.Now(), &err)
+	coreClient := minio.Core{Client: c.s3}
+	return coreClient.NewMultipartUpload(ctx, c.bucket, strings.TrimLeft(filePath, "/"), minio.PutObjectOptions{
+		ContentType:          contentType,
+		ServerSideEncryption: c.sse.forUpload(filePath),
+	})
+}
+
+func (c *S3Client) PutObjectPart(ctx context.Context, filePath, uploadID string, partNumber int, reader io.Reader, size int64) (_ minio.ObjectPart, err error) {
+	defer observeS3(c.bucket, "UploadPart", time.Now(), &err)
+	coreClient := minio.Core{Client: c.s3}
+	// Only SSE-C is sent again with each part
+	return coreClient.PutObjectPart(ctx, c.bucket, strings.TrimLeft(filePath, "/"), uploadID, partNumber, reader, size,
+		minio.PutObjectPartOptions{SSE: c.sse.customerKey(filePath)})
+}
+
+func (c *S3Client) ListObjectParts(ctx context.Context, filePath, uploadID string) (_ []minio.ObjectPart, err error) {
+	defer observeS3(c.bucket, "ListParts", time.Now(), &err)
+	coreClient := minio.Core{Client: c.s3}
+	parts := []minio.ObjectPart{}
+	marker := 0
+	for {
+		result, err := coreClient.ListObjectParts(ctx, c.bucket, strings.TrimLeft(filePath, "/"), uploadID, marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, result.ObjectParts...)
+		if !result.IsTruncated {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+// CompleteMultipartUpload assembles all the uploaded parts and returns the info of the new object.
+func (c *S3Client) CompleteMultipartUpload(ctx context.Context, filePath, uploadID string, parts []minio.ObjectPart) (minio.ObjectInfo, error) {
+	key := strings.TrimLeft(filePath, "/")
+	completeParts := make([]minio.CompletePart, 0, len(parts))
+	for _, part := range parts {
+		completeParts = append(completeParts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+	}
+
+	if err := c.completeMultipartUpload(ctx, key, uploadID, completeParts); err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	return c.StatObject(ctx, key)
+}
+
+func (c *S3Client) completeMultipartUpload(ctx context.Context, key, uploadID string, parts []minio.CompletePart) (err error) {
+	defer observeS3(c.bucket, "CompleteMultipartUpload", time.Now(), &err)
+	coreClient := minio.Core{Client: c.s3}
+	_, err = coreClient.CompleteMultipartUpload(ctx, c.bucket, key, uploadID, parts, minio.PutObjectOptions{})
+	return err
+}
+
+func (c *S3Client) AbortMultipartUpload(ctx context.Context, filePath, uploadID string) (err error) {
+	defer observeS3(c.bucket, "AbortMultipartUpload", time.Now(), &err)
+	coreClient := minio.Core{Client: c.s3}
+	return coreClient.AbortMultipartUpload(ctx, c.bucket, strings.TrimLeft(filePath, "/"), uploadID)
+}
+
+// The following methods implement object versioning.
+
+// ForEachObjectVersion calls `fn` for every version and delete marker of the objects whose key starts with `prefix`,
+// most recent first. Unless `recursive`, only the objects directly in the "directory" `prefix` are listed,
+// with the subdirectories as keys ending with a slash.
+func (c *S3Client) ForEachObjectVersion(ctx context.Context, prefix string, recursive bool, fn func(minio.ObjectInfo)) error {
+	opts := minio.ListObjectsOptions{Prefix: prefix, Recursive: recursive, WithVersions: true}
+	return c.listObjects(ctx, "ListObjectVersions", opts, fn)
+}
+
+// GetObjectVersion is GetObject for a given version of the object.
+func (c *S3Client) GetObjectVersion(ctx context.Context, filePath string, versionID string, rangeHdr string) (_ io.ReadCloser, _ http.Header, err error) {
+	filePath = strings.TrimLeft(filePath, "/")
+	ctx, span := startSpan(ctx, "s3.GetObject", attrBucket.String(c.bucket), attrKey.String(filePath), attrVersionID.String(versionID))
+	defer endSpan(span, &err)
+	defer observeS3(c.bucket, "GetObject", time.Now(), &err)
+
+	objectOptions := minio.GetObjectOptions{ServerSideEncryption: c.sse.customerKey(filePath), VersionID: versionID}
 	objectOptions.Set("Range", rangeHdr)
 	coreClient := minio.Core{Client: c.s3}
-	return coreClient.GetObject(c.bucket, filePath, objectOptions)
+	reader, info, headers, err := coreClient.GetObject(ctx, c.bucket, filePath, objectOptions)
+	span.SetAttributes(attrBytes.Int64(info.Size))
+	return reader, headers, err
 }
@@ -0,0 +1,319 @@
+package s3browser
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/minio/minio-go/v7"
+)
+
+// testBucket is the bucket served by fakeS3.
+const testBucket = "test"
+
+// fakeS3 is a path-style S3 endpoint with just what the S3 backend uses in the tests:
+// listing, HEAD, GET, PUT, multipart uploads and copies, and deletes.
+type fakeS3 struct {
+	lock    sync.Mutex
+	objects map[string]fakeObject
+	uploads map[string]map[int][]byte // upload ID -> part number -> content
+}
+
+type fakeObject struct {
+	data []byte
+	date time.Time
+}
+
+func (o fakeObject) etag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+type fakeListing struct {
+	XMLName     xml.Name      `xml:"ListBucketResult"`
+	Name        string        `xml:"Name"`
+	Prefix      string        `xml:"Prefix"`
+	KeyCount    int           `xml:"KeyCount"`
+	MaxKeys     int           `xml:"MaxKeys"`
+	IsTruncated bool          `xml:"IsTruncated"`
+	Contents    []fakeContent `xml:"Contents"`
+}
+
+type fakeContent struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type fakeDelete struct {
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+// newFakeS3 starts a fakeS3 holding testObjects, stopped at the end of the test.
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{objects: map[string]fakeObject{}, uploads: map[string]map[int][]byte{}}
+	for key, content := range testObjects {
+		f.objects[key] = fakeObject{data: []byte(content), date: testDate}
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+// object returns the content of `key`, if it exists.
+func (f *fakeS3) object(key string) ([]byte, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	obj, ok := f.objects[key]
+	return obj.data, ok
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+testBucket), "/")
+	query := r.URL.Query()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, query.Get("prefix"))
+	case key == "" && r.Method == http.MethodPost && query.Has("delete"):
+		var del fakeDelete
+		if err := xml.NewDecoder(r.Body).Decode(&del); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, obj := range del.Objects {
+			delete(f.objects, obj.Key)
+		}
+		writeXML(w, `<DeleteResult></DeleteResult>`)
+	case key == "":
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		obj, ok := f.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				io.WriteString(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+			}
+			return
+		}
+		w.Header().Set("ETag", obj.etag())
+		w.Header().Set("Content-Type", mimeType(key))
+		http.ServeContent(w, r, "", obj.date, bytes.NewReader(obj.data))
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		src, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		src = strings.TrimPrefix(strings.TrimPrefix(src, "/"), testBucket+"/")
+		obj, ok := f.objects[src]
+		if !ok {
+			http.Error(w, "no source", http.StatusNotFound)
+			return
+		}
+		obj.date = time.Now().UTC()
+		if uploadID := query.Get("uploadId"); uploadID != "" {
+			// UploadPartCopy, used by ComposeObject
+			data := obj.data
+			var start, end int
+			if _, err := fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end); err == nil {
+				data = data[start : end+1]
+			}
+			part, _ := strconv.Atoi(query.Get("partNumber"))
+			f.uploads[uploadID][part] = data
+			obj.data = data
+			writeXML(w, fmt.Sprintf(`<CopyPartResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyPartResult>`,
+				obj.etag(), obj.date.Format(time.RFC3339)))
+			return
+		}
+		f.objects[key] = obj
+		writeXML(w, fmt.Sprintf(`<CopyObjectResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyObjectResult>`,
+			obj.etag(), obj.date.Format(time.RFC3339)))
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		uploadID := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[uploadID] = map[int][]byte{}
+		writeXML(w, fmt.Sprintf(`<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`,
+			testBucket, key, uploadID))
+	case r.Method == http.MethodPut:
+		data, err := readPayload(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		obj := fakeObject{data: data, date: time.Now().UTC()}
+		if uploadID := query.Get("uploadId"); uploadID != "" {
+			part, _ := strconv.Atoi(query.Get("partNumber"))
+			f.uploads[uploadID][part] = data
+		} else {
+			f.objects[key] = obj
+		}
+		w.Header().Set("ETag", obj.etag())
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts := f.uploads[query.Get("uploadId")]
+		delete(f.uploads, query.Get("uploadId"))
+		obj := fakeObject{date: time.Now().UTC()}
+		for i := 1; i <= len(parts); i++ {
+			obj.data = append(obj.data, parts[i]...)
+		}
+		f.objects[key] = obj
+		writeXML(w, fmt.Sprintf(`<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>`,
+			testBucket, key, obj.etag()))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	out := fakeListing{Name: testBucket, Prefix: prefix, MaxKeys: 1000}
+	for key, obj := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			out.Contents = append(out.Contents, fakeContent{
+				Key:          key,
+				LastModified: obj.date.Format(time.RFC3339),
+				ETag:         obj.etag(),
+				Size:         len(obj.data),
+				StorageClass: "STANDARD",
+			})
+		}
+	}
+	sort.Slice(out.Contents, func(i, j int) bool {
+		return out.Contents[i].Key < out.Contents[j].Key
+	})
+	out.KeyCount = len(out.Contents)
+	data, _ := xml.Marshal(out)
+	writeXML(w, string(data))
+}
+
+func writeXML(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?>`+body)
+}
+
+// readPayload decodes the aws-chunked encoding minio uses to stream uploads over plain HTTP.
+func readPayload(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return ioutil.ReadAll(r.Body)
+	}
+	var data []byte
+	body := bufio.NewReader(r.Body)
+	for {
+		line, err := body.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex := strings.TrimSpace(strings.SplitN(line, ";", 2)[0])
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil // the trailers are ignored
+		}
+		chunk := make([]byte, size+2) // and its CRLF
+		if _, err := io.ReadFull(body, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+// newTestS3Browser provisions `b` with the S3 backend on a fakeS3 holding testObjects.
+func newTestS3Browser(t *testing.T, b *S3Browser) (*S3Browser, *fakeS3) {
+	t.Helper()
+
+	f, srv := newFakeS3(t)
+	if b.SiteName == "" {
+		b.SiteName = "Test"
+	}
+	b.Backend = backendS3
+	b.Endpoint = strings.TrimPrefix(srv.URL, "http://")
+	b.Region = "us-east-1"
+	b.Key = "key"
+	b.Secret = "secret"
+	b.Bucket = testBucket
+	if err := b.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := b.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return b, f
+}
+
+func TestS3Client(t *testing.T) {
+	s3browserMetrics.init.Do(initMetrics) // done by Provision
+	f, srv := newFakeS3(t)
+	c, err := NewS3Client(strings.TrimPrefix(srv.URL, "http://"), "key", "secret", false, testBucket, "us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	keys := []string{}
+	if err := c.ForEachObjectIn(ctx, "docs/", func(obj minio.ObjectInfo) { keys = append(keys, obj.Key) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(keys, ","); got != "docs/api/v1.json,docs/api/v2.json,docs/guide.txt" {
+		t.Errorf("listing: got %s", got)
+	}
+
+	obj, err := c.PutObject(ctx, "/new.txt", strings.NewReader("new content"), -1, "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Key != "new.txt" || obj.Size != 11 {
+		t.Errorf("PutObject: got %s of %d bytes", obj.Key, obj.Size)
+	}
+	if data, _ := f.object("new.txt"); string(data) != "new content" {
+		t.Errorf("PutObject: stored %q", data)
+	}
+
+	if _, err := c.CopyObject(ctx, "/new.txt", "/copy.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RemoveObjects(ctx, []string{"new.txt", "copy.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"new.txt", "copy.txt"} {
+		if _, ok := f.object(key); ok {
+			t.Errorf("%s was not removed", key)
+		}
+	}
+
+	reader, _, _, err := c.GetObject(ctx, "/b.txt", "bytes=2-4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if data, _ := ioutil.ReadAll(reader); string(data) != "234" {
+		t.Errorf("GetObject: got %q", data)
+	}
+}
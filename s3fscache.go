@@ -1,23 +1,31 @@
 package s3browser
 
 import (
+	"context"
+	"errors"
 	"path"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
-	"github.com/minio/minio-go/v6"
+	"github.com/minio/minio-go/v7"
 	"go.uber.org/zap"
 )
 
+var errCacheNotLoaded = errors.New("listing not loaded yet")
+
 type S3FsCache struct {
-	lock   sync.RWMutex
-	s3     S3Client
-	sorter *S3FsSorter
-	logger *zap.Logger
-	bucket string
-	data   map[string]Directory
+	lock    sync.RWMutex
+	backend Backend
+	sorter  *S3FsSorter
+	hide    *hider
+	logger  *zap.Logger
+	bucket  string
+	data    map[string]Directory
+	ignores map[string][]string // patterns of the ignore files by directory
+
+	onRefresh []func(dirPath string)
 }
 
 type Directory struct {
@@ -30,6 +38,15 @@ type Directory struct {
 type File struct {
 	Bytes int64
 	Date  time.Time
+	ETag  string
+}
+
+func newFile(obj minio.ObjectInfo) File {
+	return File{
+		Bytes: obj.Size,
+		Date:  obj.LastModified,
+		ETag:  obj.ETag,
+	}
 }
 
 // Caller must ensure file exists.
@@ -48,15 +65,39 @@ func (f File) HumanModTime(format string) string {
 	return f.Date.Format(format)
 }
 
-func NewS3FsCache(client S3Client, sorter *S3FsSorter, l *zap.Logger) S3FsCache {
-	return S3FsCache{
-		s3:     client,
-		sorter: sorter,
-		logger: l,
+func NewS3FsCache(backend Backend, bucket string, sorter *S3FsSorter, hide *hider, l *zap.Logger) *S3FsCache {
+	return &S3FsCache{
+		backend: backend,
+		bucket:  bucket,
+		sorter:  sorter,
+		hide:    hide,
+		logger:  l,
+	}
+}
+
+// OnRefresh registers `fn`, called with the refreshed directory after each successful refresh.
+// It must be called before the first refresh.
+func (fs *S3FsCache) OnRefresh(fn func(dirPath string)) {
+	fs.onRefresh = append(fs.onRefresh, fn)
+}
+
+func (fs *S3FsCache) refreshed(dirPath string) {
+	for _, fn := range fs.onRefresh {
+		fn(dirPath)
 	}
 }
 
+// Loaded reports whether a full refresh succeeded, until then nothing can be served.
+func (fs *S3FsCache) Loaded() bool {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	return fs.data != nil
+}
+
 func (fs *S3FsCache) GetDir(dirPath string) (Directory, bool) {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+
 	dir, ok := fs.data[normalizePath(dirPath)]
 	return dir, ok
 }
@@ -74,46 +115,346 @@ func (fs *S3FsCache) GetFile(filePath string) (File, bool) {
 	return file, file != File{}
 }
 
-func (fs *S3FsCache) Refresh() (err error) {
+// Walk calls `fn` for the directory `dirPath` and all its subdirectories, parents first.
+// `fn` must not call any other method of the cache.
+func (fs *S3FsCache) Walk(dirPath string, fn func(Directory)) {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+
+	var walk func(string)
+	walk = func(currPath string) {
+		dir, ok := fs.data[currPath]
+		if !ok {
+			return
+		}
+		fn(dir)
+		for _, folder := range dir.Folders {
+			walk(path.Join(currPath, folder))
+		}
+	}
+	walk(normalizePath(dirPath))
+}
+
+// Refresh replaces the whole cache, it returns the number of objects listed.
+func (fs *S3FsCache) Refresh(ctx context.Context) (objects int, err error) {
 	fs.logger.Info("Refreshing S3 cache")
 
 	newData := map[string]Directory{}
 	addDirectory(fs.logger, newData, "/")
 
-	fs.s3.ForEachObject(func(obj minio.ObjectInfo) {
-		objDir, objName := path.Split(obj.Key)
-		objDir = normalizePath(objDir)
+	err = fs.backend.ForEachObjectIn(ctx, "", func(obj minio.ObjectInfo) {
+		objects++
+		fs.addObjectTo(newData, obj)
+	})
+	if err != nil {
+		// Keep serving the previous listing
+		return objects, err
+	}
 
-		// Add any missing parent directories in `newData`
-		if _, ok := newData[objDir]; !ok {
-			addDirectory(fs.logger, newData, objDir)
-		}
+	fs.sortAll(newData)
+	ignores := fs.loadIgnoreFiles(ctx, newData)
+	fs.applyHide(newData, ignores, "/")
 
-		// Add the object
-		if objName != "" { // "": obj is the directory itself
-			fs.logger.Debug("file", zap.String("dir", objDir), zap.String("name", objName))
+	fs.lock.Lock()
+	fs.data = newData
+	fs.ignores = ignores
+	fs.lock.Unlock()
+	fs.refreshed("/")
 
-			fsCopy := newData[objDir]
-			fsCopy.files[objName] = File{
-				Bytes: obj.Size,
-				Date:  obj.LastModified,
-			}
-			fsCopy.Filenames = append(fsCopy.Filenames, objName)
-			newData[objDir] = fsCopy
+	fs.logger.Info("S3 cache updated")
+	return objects, nil
+}
+
+// RefreshPrefix only refreshes the directory `dirPath` and its subdirectories,
+// or the file `dirPath`. It returns the number of objects listed.
+func (fs *S3FsCache) RefreshPrefix(ctx context.Context, dirPath string) (objects int, err error) {
+	dirPath = normalizePath(dirPath)
+	if dirPath == "/" {
+		return fs.Refresh(ctx)
+	}
+	if _, isDir := fs.GetDir(dirPath); !isDir {
+		obj, err := fs.backend.StatObject(ctx, dirPath)
+		if err == nil {
+			fs.AddObject(obj)
+			fs.refreshed(dirPath)
+			fs.logger.Info("S3 cache updated", zap.String("file", dirPath))
+			return 1, nil
+		}
+		// Otherwise a new directory, or a deleted file removed below
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			return 0, err
 		}
+	}
+	fs.logger.Info("Refreshing S3 cache", zap.String("prefix", dirPath))
+
+	newData := map[string]Directory{}
+	addDirectory(fs.logger, newData, dirPath)
+	err = fs.backend.ForEachObjectIn(ctx, strings.TrimLeft(dirPath, "/")+"/", func(obj minio.ObjectInfo) {
+		objects++
+		fs.addObjectTo(newData, obj)
 	})
+	if err != nil {
+		return objects, err
+	}
+
+	fs.sortAll(newData)
+	newIgnores := fs.loadIgnoreFiles(ctx, newData)
+
+	defer fs.refreshed(dirPath) // after the lock is released
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	ignores := map[string][]string{}
+	for currPath, patterns := range fs.ignores {
+		if !isUnder(currPath, dirPath) {
+			ignores[currPath] = patterns
+		}
+	}
+	for currPath, patterns := range newIgnores {
+		ignores[currPath] = patterns
+	}
+	fs.ignores = ignores
+
+	// The parents in newData are incomplete, only the subtree is used
+	fs.removeLocked(dirPath)
+	if objects == 0 {
+		fs.logger.Info("S3 cache updated, prefix is empty", zap.String("prefix", dirPath))
+		return objects, nil
+	}
+	if fs.hiddenPath(dirPath) {
+		return objects, nil
+	}
+	fs.ensureDirectory(dirPath)
+	for currPath, dir := range newData {
+		if isUnder(currPath, dirPath) {
+			fs.data[currPath] = dir
+		}
+	}
+	fs.applyHide(fs.data, fs.ignores, dirPath)
+
+	fs.logger.Info("S3 cache updated", zap.String("prefix", dirPath))
+	return objects, nil
+}
 
+// addObjectTo adds an object listed by a refresh to `data`.
+func (fs *S3FsCache) addObjectTo(data map[string]Directory, obj minio.ObjectInfo) {
+	objDir, objName := path.Split(obj.Key)
+	objDir = normalizePath(objDir)
+
+	// Add any missing parent directories in `data`
+	if _, ok := data[objDir]; !ok {
+		addDirectory(fs.logger, data, objDir)
+	}
+
+	// Add the object
+	if objName != "" { // "": obj is the directory itself
+		fs.logger.Debug("file", zap.String("dir", objDir), zap.String("name", objName))
+
+		fsCopy := data[objDir]
+		fsCopy.files[objName] = newFile(obj)
+		fsCopy.Filenames = append(fsCopy.Filenames, objName)
+		data[objDir] = fsCopy
+	}
+}
+
+func (fs *S3FsCache) sortAll(data map[string]Directory) {
 	if fs.sorter != nil {
-		for _, dir := range newData {
+		for _, dir := range data {
 			fs.sorter.Sort(dir.Folders)
 			fs.sorter.Sort(dir.Filenames)
 		}
 	}
+}
 
-	fs.data = newData
+// Stats returns the number of directories and files, and the total size of the files.
+func (fs *S3FsCache) Stats() (dirs int, files int, bytes int64) {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
 
-	fs.logger.Info("S3 cache updated")
-	return nil
+	for _, dir := range fs.data {
+		dirs++
+		files += len(dir.files)
+		for _, file := range dir.files {
+			bytes += file.Bytes
+		}
+	}
+	return dirs, files, bytes
+}
+
+// The following methods patch the cache right after a change made through
+// the plugin, so it is visible without waiting for the next refresh.
+// Directories are copied before being modified since callers of GetDir
+// may still be using the previous version.
+
+// AddFile adds or replaces a file, missing parent directories are created.
+func (fs *S3FsCache) AddFile(filePath string, file File) {
+	dirPath, name := path.Split(normalizePath(filePath))
+	dirPath = normalizePath(dirPath)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.hiddenPath(dirPath) {
+		return
+	}
+	hidden := fs.hide.hidden(fs.ignores, path.Join(dirPath, name), false)
+	if hidden && !fs.hide.listingOnly {
+		return
+	}
+
+	fs.ensureDirectory(dirPath)
+	dir := fs.data[dirPath].clone()
+	if _, ok := dir.files[name]; !ok && !hidden {
+		dir.Filenames = append(dir.Filenames, name)
+		fs.sort(dir.Filenames)
+	}
+	dir.files[name] = file
+	fs.data[dirPath] = dir
+}
+
+// AddObject adds a file, or a directory for "folder/" objects.
+func (fs *S3FsCache) AddObject(obj minio.ObjectInfo) {
+	if strings.HasSuffix(obj.Key, "/") {
+		fs.AddDir(obj.Key)
+	} else {
+		fs.AddFile(obj.Key, newFile(obj))
+	}
+}
+
+// AddDir adds a directory and its missing parents.
+func (fs *S3FsCache) AddDir(dirPath string) {
+	dirPath = normalizePath(dirPath)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if !fs.hiddenPath(dirPath) {
+		fs.ensureDirectory(dirPath)
+	}
+}
+
+// Remove removes a file, or a directory and everything below it.
+func (fs *S3FsCache) Remove(p string) {
+	p = normalizePath(p)
+	if p == "/" {
+		return
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.removeLocked(p)
+}
+
+// Caller must hold the lock, `p` must be normalized
+func (fs *S3FsCache) removeLocked(p string) {
+	parentPath, name := path.Split(p)
+	parentPath = normalizePath(parentPath)
+
+	parent, ok := fs.data[parentPath]
+	if !ok {
+		return
+	}
+	parent = parent.clone()
+
+	if _, ok := fs.data[p]; ok {
+		for dirPath := range fs.data {
+			if isUnder(dirPath, p) {
+				delete(fs.data, dirPath)
+			}
+		}
+		parent.Folders = removeName(parent.Folders, name)
+	} else {
+		delete(parent.files, name)
+		parent.Filenames = removeName(parent.Filenames, name)
+	}
+	fs.data[parentPath] = parent
+}
+
+// Caller must hold the lock, `dirPath` must be normalized
+func (fs *S3FsCache) ensureDirectory(dirPath string) {
+	if _, ok := fs.data[dirPath]; ok {
+		return
+	}
+
+	parentPath, name := path.Split(dirPath)
+	parentPath = normalizePath(parentPath)
+	fs.ensureDirectory(parentPath)
+
+	// Hidden directories (listingOnly) exist but are not listed
+	if !fs.hide.hidden(fs.ignores, dirPath, true) {
+		parent := fs.data[parentPath].clone()
+		parent.Folders = append(parent.Folders, name)
+		fs.sort(parent.Folders)
+		fs.data[parentPath] = parent
+	}
+
+	fs.data[dirPath] = Directory{
+		Path:      dirPath,
+		Folders:   []string{},
+		Filenames: []string{},
+		files:     map[string]File{},
+	}
+}
+
+// Hidden checks if the file `filePath` is hidden, for paths that may not be in the cache.
+func (fs *S3FsCache) Hidden(filePath string) bool {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+
+	filePath = normalizePath(filePath)
+	if fs.hide == nil || fs.hide.listingOnly {
+		return false
+	}
+	return fs.hide.hidden(fs.ignores, filePath, false) || fs.hiddenPath(path.Dir(filePath))
+}
+
+// hiddenPath checks if the directory `dirPath` or one of its parents is entirely hidden.
+// Caller must hold the lock, `dirPath` must be normalized
+func (fs *S3FsCache) hiddenPath(dirPath string) bool {
+	if fs.hide == nil || fs.hide.listingOnly {
+		return false
+	}
+	for ; dirPath != "/"; dirPath = path.Dir(dirPath) {
+		if fs.hide.hidden(fs.ignores, dirPath, true) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *S3FsCache) sort(names []string) {
+	if fs.sorter != nil {
+		fs.sorter.Sort(names)
+	}
+}
+
+func (d Directory) clone() Directory {
+	c := Directory{
+		Path:      d.Path,
+		Folders:   append([]string{}, d.Folders...),
+		Filenames: append([]string{}, d.Filenames...),
+		files:     make(map[string]File, len(d.files)),
+	}
+	for name, file := range d.files {
+		c.files[name] = file
+	}
+	return c
+}
+
+func removeName(names []string, name string) []string {
+	out := make([]string, 0, len(names))
+	for _, curr := range names {
+		if curr != name {
+			out = append(out, curr)
+		}
+	}
+	return out
+}
+
+// isUnder checks if the normalized path `p` is `dirPath` or below it.
+func isUnder(p string, dirPath string) bool {
+	return dirPath == "/" || p == dirPath || strings.HasPrefix(p, dirPath+"/")
 }
 
 // Ensure path starts with / and doesn't end with one
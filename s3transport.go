@@ -0,0 +1,107 @@
+package s3browser
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/minio/minio-go/v7/pkg/signer"
+)
+
+// Values for the "tier" label of s3_requests_total, after the S3 pricing
+const (
+	requestTier1 = "tier1" // PUT, COPY, POST and LIST requests
+	requestTier2 = "tier2" // GET, HEAD and the other requests
+	requestFree  = "free"  // DELETE requests
+)
+
+// signV4Credential starts the Authorization header of the requests signed by minio-go.
+const signV4Credential = "AWS4-HMAC-SHA256 Credential="
+
+// s3Transport makes the requests of an S3Client: it counts them and adds the extra headers.
+//
+// minio-go can't add headers to every request, and S3 rejects the x-amz-* headers that are not signed,
+// so the requests signed in their headers are signed again with the extra headers.
+type s3Transport struct {
+	base   http.RoundTripper
+	bucket string
+	key    string
+	secret string
+	header http.Header // extra headers, see s3_header and requester_pays
+}
+
+func (t *s3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s3browserMetrics.s3Requests.WithLabelValues(t.bucket, requestTier(req.Method, req.URL.Query())).Inc()
+	if len(t.header) == 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	// A RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	presigned := req.URL.Query().Get("X-Amz-Signature") != ""
+	for name, values := range t.header {
+		// The x-amz-* headers of presigned requests are in the signed query, see presignParams
+		if presigned && isAmzHeader(name) {
+			continue
+		}
+		req.Header[name] = values
+	}
+	if region, ok := signedRegion(req); ok {
+		req = signer.SignV4(*req, t.key, t.secret, "", region)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// signedRegion returns the region of a request signed in its headers by minio-go.
+// Streaming uploads (plain HTTP endpoints) chain the signatures of their chunks
+// to the one of the headers, they can't be signed again.
+func signedRegion(req *http.Request) (string, bool) {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, signV4Credential) {
+		return "", false
+	}
+	if strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return "", false
+	}
+	// Credential=<key>/<date>/<region>/s3/aws4_request, ...
+	credential := strings.TrimPrefix(auth, signV4Credential)
+	credential = strings.SplitN(credential, ",", 2)[0]
+	scope := strings.Split(credential, "/")
+	if len(scope) < 5 {
+		return "", false
+	}
+	return scope[len(scope)-3], true
+}
+
+func isAmzHeader(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), "x-amz-")
+}
+
+// requestTier estimates the pricing tier of a request, from its method and query.
+func requestTier(method string, query url.Values) string {
+	switch method {
+	case http.MethodPut, http.MethodPost:
+		return requestTier1
+	case http.MethodDelete:
+		return requestFree
+	}
+	// Listings of objects, versions, uploads and parts
+	for _, param := range []string{"list-type", "versions", "uploads", "uploadId"} {
+		if _, ok := query[param]; ok {
+			return requestTier1
+		}
+	}
+	return requestTier2
+}
+
+// requestHeader returns the extra headers of the requests to S3.
+func requestHeader(extra map[string]string, requesterPays bool) http.Header {
+	header := http.Header{}
+	for name, value := range extra {
+		header.Set(name, value)
+	}
+	if requesterPays {
+		header.Set("X-Amz-Request-Payer", "requester")
+	}
+	return header
+}
@@ -1,13 +1,33 @@
 package s3browser
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/minio/minio-go/v7"
+)
+
+// Presigned URLs: S3 does not accept more than 7 days
+const (
+	defaultSignedURLExpiry = 10 * time.Minute
+	maxSignedURLExpiry     = 7 * 24 * time.Hour
+)
+
+// Values for signed_url_content_disposition
+const (
+	dispositionInline     = "inline"
+	dispositionAttachment = "attachment"
 )
 
 func (b S3Browser) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
@@ -16,64 +36,166 @@ func (b S3Browser) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyh
 		fullPath = "/"
 	}
 
+	if probe, ok := r.URL.Query()["health"]; ok {
+		return b.serveHealth(w, r, probe[0])
+	}
+	if b.shares != nil {
+		if token, ok := r.URL.Query()["share"]; ok {
+			return b.serveShare(w, r, token[0])
+		}
+		r = b.shares.withGrant(r)
+	}
+	if b.acl != nil {
+		r = b.acl.withSubject(r)
+	}
+
+	if _, ok := r.URL.Query()["refresh"]; ok {
+		return b.serveRefreshAPI(w, r)
+	}
+	if !b.s3Cache.Loaded() && !(r.Method == http.MethodPost && r.URL.RawQuery == "") {
+		// The first refresh failed, it is retried (a POST without query triggers it too)
+		w.Header().Set("Retry-After", strconv.Itoa(int(refreshRetryInterval.Seconds())))
+		return caddyhttp.Error(http.StatusServiceUnavailable, errCacheNotLoaded)
+	}
+	if _, ok := r.URL.Query()["manage"]; ok && (b.Manage || b.shares != nil) {
+		return b.serveManage(w, r)
+	}
+	if _, ok := r.URL.Query()["stats"]; ok && b.downloads != nil {
+		return b.serveDownloadStats(w, r)
+	}
+	if _, ok := r.URL.Query()["upload"]; ok && b.Upload {
+		return b.serveUpload(w, r)
+	}
+
 	switch r.Method {
 	case http.MethodGet, http.MethodHead:
 		// proceed, noop
 	case http.MethodPost:
-		return b.serveAPI(w, r)
+		return b.serveRefreshAPI(w, r)
 	case "PROPFIND", http.MethodOptions:
+		if b.WebDAV {
+			return b.serveWebDAV(w, r)
+		}
 		return caddyhttp.Error(http.StatusNotImplemented, nil)
+	case http.MethodPut, http.MethodDelete, "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK":
+		if b.WebDAV {
+			return b.serveWebDAV(w, r)
+		}
+		return next.ServeHTTP(w, r)
 	default:
 		return next.ServeHTTP(w, r)
 	}
 
+	// Previous versions may be of deleted files, missing from the cache
+	if b.Versioning {
+		if _, ok := r.URL.Query()["versions"]; ok {
+			return b.serveVersions(w, r, normalizePath(fullPath))
+		}
+		if versionID := r.URL.Query().Get("versionId"); versionID != "" {
+			return b.serveVersion(w, r, normalizePath(fullPath), versionID)
+		}
+	}
+
 	if dir, ok := b.s3Cache.GetDir(fullPath); ok {
-		return b.serveDirectory(w, r, dir)
+		if !b.allowed(r, permList, fullPath) {
+			return b.denied(r, fullPath)
+		}
+		return b.serveDirectory(w, r, b.filterDir(r, dir))
+	}
+
+	if file, ok := b.s3Cache.GetFile(fullPath); ok {
+		if !b.allowed(r, permDownload, fullPath) {
+			return b.denied(r, fullPath)
+		}
+		if _, ok := r.URL.Query()["thumbnail"]; ok && b.thumbnails != nil && isImage(fullPath) {
+			return b.serveThumbnail(w, r, normalizePath(fullPath), file)
+		}
+		if _, ok := r.URL.Query()["preview"]; ok {
+			return b.servePreview(w, r, normalizePath(fullPath), file)
+		}
+		return b.serveDownload(w, r, normalizePath(fullPath), file.Bytes)
 	}
 
-	if _, ok := b.s3Cache.GetFile(fullPath); ok {
-		if b.SignedURLRedirect {
-			return b.signedRedirect(w, r, normalizePath(fullPath))
+	if b.checksums != nil {
+		if algo, targetPath, ok := b.checksumTarget(fullPath); ok {
+			return b.serveChecksum(w, r, algo, targetPath)
 		}
-		return b.serveFile(w, r, normalizePath(fullPath))
 	}
 
 	return next.ServeHTTP(w, r)
 }
 
-func (b *S3Browser) serveAPI(w http.ResponseWriter, r *http.Request) error {
-	if b.RefreshAPISecret != "" {
-		if _, pwd, ok := r.BasicAuth(); !ok || pwd != b.RefreshAPISecret {
-			return caddyhttp.Error(http.StatusUnauthorized, nil)
+// serveDownload sends the file, or redirects to a presigned URL with signed_url_redirect.
+// `size` is the size of the file, see signed_url_min_size.
+func (b *S3Browser) serveDownload(w http.ResponseWriter, r *http.Request, filePath string, size int64) error {
+	// Clients can't send the SSE-C key of presigned URLs
+	if b.SignedURLRedirect && size >= b.SignedURLMinSize && b.sse.customerKey(filePath) == nil {
+		s3browserMetrics.downloads.WithLabelValues(b.Bucket, downloadRedirected).Inc()
+		// Made by the client, but billed to the bucket owner or the requester
+		s3browserMetrics.s3Requests.WithLabelValues(b.Bucket, requestTier2).Inc()
+		err := b.signedRedirect(w, r, filePath)
+		if err == nil {
+			if b.downloads != nil {
+				b.downloads.Record(r, filePath, downloadRedirect)
+			}
+			b.countShareDownload(r, filePath, downloadRedirect)
 		}
+		return err
 	}
-
-	b.refreshTrigger <- struct{}{}
-	return nil
+	s3browserMetrics.downloads.WithLabelValues(b.Bucket, downloadProxied).Inc()
+	return b.serveFile(w, r, filePath)
 }
 
-func (b *S3Browser) serveDirectory(w http.ResponseWriter, r *http.Request, dir Directory) error {
-	renderFunc := b.renderHTML
-	contentType := "text/html"
-
-	acceptHeader := strings.ToLower(strings.Join(r.Header["Accept"], ","))
-	if strings.Contains(acceptHeader, "application/json") {
-		renderFunc = b.renderJSON
-		contentType = "application/json"
+func (b *S3Browser) serveDirectory(w http.ResponseWriter, r *http.Request, dir Directory) (err error) {
+	format := r.URL.Query().Get("format")
+	switch {
+	case format == formatAtom || format == formatRSS:
+	case recursiveRequested(r):
+		format = formatTree
+	case wantsJSON(r):
+		format = formatJSON
+	default:
+		format = formatHTML
 	}
+	defer observeRender(b.Bucket, format, time.Now())
+	ctx, span := startSpan(r.Context(), "s3browser.listing", attrPath.String(dir.Path), attrFormat.String(format))
+	defer endSpan(span, &err)
+	r = r.WithContext(ctx)
 
-	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	switch format {
+	case formatAtom, formatRSS:
+		return b.serveFeed(w, r, dir, format)
+	case formatTree:
+		return b.serveTree(w, r, dir)
+	case formatJSON:
+		return b.serveJSON(w, r, dir)
+	}
 
-	return renderFunc(w, dir)
+	csrfToken, uploadToken := "", ""
+	if (b.Manage || b.shares != nil) && authorized(r, b.ManageSecret) {
+		csrfToken = b.csrfToken(r)
+	}
+	if b.Upload && authorized(r, b.UploadSecret) {
+		uploadToken = b.csrfToken(r)
+	}
+	var deleted []DeletedFile
+	if _, ok := r.URL.Query()["deleted"]; ok && b.Versioning {
+		if deleted, err = b.deletedFiles(r, dir); err != nil {
+			return err
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Vary", "Accept")
+	return b.renderHTML(ctx, w, dir, b.layout(r, dir), csrfToken, uploadToken, deleted)
 }
 
-func (b *S3Browser) renderJSON(w io.Writer, dir Directory) error {
+func (b *S3Browser) writeJSON(w io.Writer, v interface{}) error {
 	var data []byte
 	var err error
 	if !b.Debug {
-		data, err = json.Marshal(dir)
+		data, err = json.Marshal(v)
 	} else {
-		data, err = json.MarshalIndent(dir, "", "  ")
+		data, err = json.MarshalIndent(v, "", "  ")
 	}
 	if err != nil {
 		return err
@@ -83,45 +205,175 @@ func (b *S3Browser) renderJSON(w io.Writer, dir Directory) error {
 	return err
 }
 
-func (b *S3Browser) renderHTML(w io.Writer, dir Directory) error {
+// layout returns the layout requested with `?layout=`, if none is requested
+// directories containing mostly images are displayed as a gallery.
+func (b *S3Browser) layout(r *http.Request, dir Directory) string {
+	if b.thumbnails == nil {
+		return layoutList
+	}
+
+	switch r.URL.Query().Get("layout") {
+	case layoutList:
+		return layoutList
+	case layoutGrid:
+		return layoutGrid
+	}
+
+	images := 0
+	for _, name := range dir.Filenames {
+		if isImage(name) {
+			images++
+		}
+	}
+	if images > 0 && images*2 >= len(dir.Filenames) {
+		return layoutGrid
+	}
+	return layoutList
+}
+
+// renderHTML renders the listing, the management actions are displayed when `csrfToken` is set
+// and the upload drop zone when `uploadToken` is set.
+// The `deleted` files are listed after the others when not nil, see `?deleted`.
+func (b *S3Browser) renderHTML(ctx context.Context, w io.Writer, dir Directory, layout string, csrfToken, uploadToken string, deleted []DeletedFile) error {
+	var counts map[string]int64
+	if b.DownloadStatsColumn {
+		counts = b.downloads.Totals(dir)
+	}
 	return b.template.Execute(w, TemplateArgs{
-		SiteName: b.SiteName,
-		Dir:      dir,
+		SiteName:    b.SiteName,
+		Dir:         dir,
+		Layout:      layout,
+		Thumbnails:  b.thumbnails != nil,
+		Upload:      b.Upload,
+		Resumable:   b.s3Client() != nil,
+		Manage:      b.Manage,
+		Share:       b.shares != nil,
+		CSRFToken:   csrfToken,
+		UploadToken: uploadToken,
+		Downloads:   b.DownloadStatsColumn,
+		Counts:      counts,
+		Versioning:  b.Versioning,
+		Deleted:     deleted,
+		ShowDeleted: deleted != nil,
+		Header:      b.readmeCache.Render(ctx, dir, b.HeaderFiles),
+		Readme:      b.readmeCache.Render(ctx, dir, b.ReadmeFiles),
 	})
 }
 
-func (b *S3Browser) signedRedirect(w http.ResponseWriter, r *http.Request, filePath string) error {
-	client := b.newS3Client()
-	url, err := client.s3.PresignedGetObject(b.Bucket, filePath[1:], 10*time.Minute, nil)
-	if err == nil {
+func (b *S3Browser) signedRedirect(w http.ResponseWriter, r *http.Request, filePath string) (err error) {
+	ctx, span := startSpan(r.Context(), "s3browser.redirect", attrPath.String(filePath))
+	defer endSpan(span, &err)
+
+	expiry := b.SignedURLExpiry
+	if expiry <= 0 {
+		expiry = defaultSignedURLExpiry
+	}
+
+	params := url.Values{}
+	name := path.Base(filePath)
+	disposition := b.SignedURLDisposition
+	if _, ok := r.URL.Query()["download"]; ok {
+		disposition = dispositionAttachment
+	}
+	if disposition != "" {
+		params.Set("response-content-disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	}
+	if b.SignedURLContentType {
+		params.Set("response-content-type", mimeType(name))
+	}
+	if versionID := r.URL.Query().Get("versionId"); versionID != "" && b.Versioning {
+		params.Set("versionId", versionID)
+	}
+
+	client := b.presignClient
+	signedURL, err := client.PresignedGetObject(ctx, filePath, expiry, params)
+	if err != nil {
 		return err
 	}
-	http.Redirect(w, r, url.String(), http.StatusTemporaryRedirect)
+
+	// The reverse proxy in front of S3 is expected to strip the prefix
+	if b.signedURLBase != nil && strings.Trim(b.signedURLBase.Path, "/") != "" {
+		prefix := strings.TrimSuffix(b.signedURLBase.Path, "/")
+		signedURL.RawPath = (&url.URL{Path: prefix}).EscapedPath() + signedURL.EscapedPath()
+		signedURL.Path = prefix + signedURL.Path
+	}
+
+	http.Redirect(w, r, signedURL.String(), http.StatusTemporaryRedirect)
 	return nil
 }
 
-func (b *S3Browser) serveFile(w http.ResponseWriter, r *http.Request, filePath string) error {
-	client := b.newS3Client()
+func (b *S3Browser) serveThumbnail(w http.ResponseWriter, r *http.Request, filePath string, file File) (err error) {
+	ctx, span := startSpan(r.Context(), "s3browser.thumbnail", attrPath.String(filePath))
+	defer endSpan(span, &err)
+
+	size := defaultThumbnailSize
+	if val := r.URL.Query().Get("thumbnail"); val != "" {
+		size, err = strconv.Atoi(val)
+		if err != nil || size <= 0 || size > maxThumbnailSize {
+			return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid thumbnail size: %q", val))
+		}
+	}
+
+	data, err := b.thumbnails.Get(ctx, filePath, file, size)
+	if err == errSourceTooLarge {
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, "", file.Date, bytes.NewReader(data))
+	return nil
+}
 
+func (b *S3Browser) serveFile(w http.ResponseWriter, r *http.Request, filePath string) (err error) {
+	ctx, span := startSpan(r.Context(), "s3browser.download", attrPath.String(filePath))
+	defer endSpan(span, &err)
 	var rangeHdr string
 	if val, ok := r.Header["Range"]; ok {
 		rangeHdr = val[0]
 	}
 
-	reader, _, headers, err := client.GetObject(filePath, rangeHdr)
+	var reader io.ReadCloser
+	var headers http.Header
+	if versionID := r.URL.Query().Get("versionId"); versionID != "" && b.Versioning {
+		client := b.s3Client()
+		reader, headers, err = client.GetObjectVersion(ctx, filePath, versionID, rangeHdr)
+	} else {
+		reader, _, headers, err = b.store.GetObject(ctx, filePath, rangeHdr)
+	}
+	if minio.ToErrorResponse(err).StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return caddyhttp.Error(http.StatusRequestedRangeNotSatisfiable, err)
+	}
 	if err != nil {
 		return err
 	}
+	defer reader.Close()
 
 	w.Header().Set("Content-Type", headers.Get("Content-Type"))
 	w.Header().Set("Content-Length", headers.Get("Content-Length"))
+	w.Header().Set("Accept-Ranges", "bytes")
+	for _, name := range []string{"ETag", "Last-Modified"} {
+		if val := headers.Get(name); val != "" {
+			w.Header().Set(name, val)
+		}
+	}
 	if headers.Get("Content-Range") != "" {
 		w.Header().Set("Content-Range", headers.Get("Content-Range"))
+		w.WriteHeader(http.StatusPartialContent)
 	}
 
-	if _, err := io.Copy(w, reader); err != nil {
-		return err
+	n, err := io.Copy(w, reader)
+	s3browserMetrics.servedBytes.WithLabelValues(b.Bucket).Add(float64(n))
+	span.SetAttributes(attrBytes.Int64(n))
+	kind := downloadComplete
+	if err != nil || headers.Get("Content-Range") != "" {
+		kind = downloadPartial
 	}
-
-	return nil
+	if b.downloads != nil {
+		b.downloads.Record(r, filePath, kind)
+	}
+	b.countShareDownload(r, filePath, kind)
+	return err
 }
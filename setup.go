@@ -14,9 +14,13 @@ package s3browser
 // and Caddy calls ServeHTTP (serve.go) for each request.
 
 import (
+	"crypto/rand"
 	"fmt"
 	"html/template"
 	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -25,12 +29,14 @@ import (
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"go.uber.org/zap"
+	"golang.org/x/net/webdav"
 )
 
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*S3Browser)(nil)
 	_ caddy.Validator             = (*S3Browser)(nil)
+	_ caddy.CleanerUpper          = (*S3Browser)(nil)
 	_ caddyfile.Unmarshaler       = (*S3Browser)(nil)
 	_ caddyhttp.MiddlewareHandler = (*S3Browser)(nil)
 )
@@ -51,13 +57,89 @@ type S3Browser struct {
 	Secure            bool          `json:"secure,omitempty"`
 	RefreshInterval   time.Duration `json:"refresh_interval,omitempty"`
 	RefreshAPISecret  string        `json:"refresh_api_secret,omitempty"`
+	RefreshAPITokens  []string      `json:"refresh_api_tokens,omitempty"`
 	Debug             bool          `json:"debug,omitempty"`
 	SignedURLRedirect bool          `json:"signed_url_redirect,omitempty"`
 	SortAlgorithm     string        `json:"sort_algorithm,omitempty"`
+	HeaderFiles       []string      `json:"header_files,omitempty"`
+	ReadmeFiles       []string      `json:"readme_files,omitempty"`
+	ReadmeMaxSize     int64         `json:"readme_max_size,omitempty"`
+	Thumbnails        bool          `json:"thumbnails,omitempty"`
+	ThumbnailCacheDir string        `json:"thumbnail_cache_dir,omitempty"`
+	ThumbnailCacheMax int64         `json:"thumbnail_cache_max,omitempty"`
+	ThumbnailMaxSize  int64         `json:"thumbnail_max_source_size,omitempty"`
+	PreviewMaxSize    int64         `json:"preview_max_size,omitempty"`
+	Checksums         bool          `json:"checksums,omitempty"`
+	FeedSize          int           `json:"feed_size,omitempty"`
+	WebDAV            bool          `json:"webdav,omitempty"`
+	WebDAVWritable    bool          `json:"webdav_writable,omitempty"`
+	Upload            bool          `json:"upload,omitempty"`
+	UploadSecret      string        `json:"upload_secret,omitempty"`
+	UploadMaxSize     int64         `json:"upload_max_size,omitempty"`
+	UploadExtensions  []string      `json:"upload_extensions,omitempty"`
+	UploadOverwrite   string        `json:"upload_overwrite,omitempty"`
+	Manage            bool          `json:"manage,omitempty"`
+	ManageSecret      string        `json:"manage_secret,omitempty"`
+	ACL               []ACLRule     `json:"acl,omitempty"`
+	ACLGroupClaim     string        `json:"acl_group_claim,omitempty"`
+	Hide              []string      `json:"hide,omitempty"`
+	HideRegex         []string      `json:"hide_regex,omitempty"`
+	HideListingOnly   bool          `json:"hide_listing_only,omitempty"`
+	HideIgnoreFile    string        `json:"hide_ignore_file,omitempty"`
+	Share             bool          `json:"share,omitempty"`
+	ShareSecret       string        `json:"share_secret,omitempty"`
+	ShareMaxExpiry    time.Duration `json:"share_max_expiry,omitempty"`
+	Versioning        bool          `json:"versioning,omitempty"`
 
-	s3Cache        S3FsCache
-	template       *template.Template
-	refreshTrigger chan struct{}
+	// Presigned URLs, with signed_url_redirect
+	SignedURLExpiry      time.Duration `json:"signed_url_expiry,omitempty"`
+	SignedURLDisposition string        `json:"signed_url_content_disposition,omitempty"`
+	SignedURLContentType bool          `json:"signed_url_content_type,omitempty"`
+	SignedURLBaseURL     string        `json:"signed_url_base_url,omitempty"`
+	SignedURLMinSize     int64         `json:"signed_url_min_size,omitempty"`
+
+	// Download counters, with download_stats
+	DownloadStats       bool     `json:"download_stats,omitempty"`
+	DownloadStatsDB     string   `json:"download_stats_db,omitempty"`
+	DownloadStatsColumn bool     `json:"download_stats_column,omitempty"`
+	DownloadStatsSecret string   `json:"download_stats_secret,omitempty"`
+	DownloadStatsIgnore []string `json:"download_stats_ignore_agents,omitempty"`
+
+	// Server-side encryption
+	SSECustomerKeys  []SSECustomerKey `json:"sse_customer_keys,omitempty"`
+	UploadEncryption string           `json:"upload_encryption,omitempty"`
+	UploadKMSKeyID   string           `json:"upload_kms_key_id,omitempty"`
+
+	// Storage of the files, see Backend
+	Backend     string `json:"backend,omitempty"`
+	BackendRoot string `json:"backend_root,omitempty"`
+
+	// Extra headers of the requests to S3, see s3_header
+	RequesterPays bool              `json:"requester_pays,omitempty"`
+	S3Headers     map[string]string `json:"s3_headers,omitempty"`
+
+	// Health checks, see ?health
+	HealthReadyMaxAge time.Duration `json:"health_ready_max_age,omitempty"`
+	HealthLiveMaxAge  time.Duration `json:"health_live_max_age,omitempty"`
+	HealthCheckS3     bool          `json:"health_check_s3,omitempty"`
+
+	s3Cache       *S3FsCache
+	readmeCache   *ReadmeCache
+	thumbnails    *ThumbnailCache
+	checksums     *ChecksumCache
+	davHandler    *webdav.Handler
+	csrfKey       []byte
+	acl           *accessControl
+	shares        *ShareStore
+	store         Backend
+	presignClient Backend
+	signedURLBase *url.URL
+	sse           *serverSideEncryption
+	s3Header      http.Header
+	template      *template.Template
+	refresher     *Refresher
+	downloads     *DownloadStats
+	s3Health      *s3Health
 
 	log *zap.Logger
 }
@@ -93,12 +175,124 @@ func (b *S3Browser) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			err = parseDurationArg(d, &b.RefreshInterval)
 		case "refresh_api_secret":
 			err = parseStringArg(d, &b.RefreshAPISecret)
+		case "refresh_api_tokens":
+			err = parseStringsArg(d, &b.RefreshAPITokens)
 		case "debug":
 			err = parseBoolArg(d, &b.Debug)
 		case "signed_url_redirect":
 			err = parseBoolArg(d, &b.SignedURLRedirect)
+		case "signed_url_expiry":
+			err = parseDurationArg(d, &b.SignedURLExpiry)
+		case "signed_url_content_disposition":
+			err = parseStringArg(d, &b.SignedURLDisposition)
+		case "signed_url_content_type":
+			err = parseBoolArg(d, &b.SignedURLContentType)
+		case "signed_url_base_url":
+			err = parseStringArg(d, &b.SignedURLBaseURL)
+		case "signed_url_min_size":
+			err = parseSizeArg(d, &b.SignedURLMinSize)
 		case "sort_algorithm":
 			err = parseStringArg(d, &b.SortAlgorithm)
+		case "header_files":
+			err = parseStringsArg(d, &b.HeaderFiles)
+		case "readme_files":
+			err = parseStringsArg(d, &b.ReadmeFiles)
+		case "readme_max_size":
+			err = parseSizeArg(d, &b.ReadmeMaxSize)
+		case "thumbnails":
+			err = parseBoolArg(d, &b.Thumbnails)
+		case "thumbnail_cache_dir":
+			err = parseStringArg(d, &b.ThumbnailCacheDir)
+		case "thumbnail_cache_max":
+			err = parseSizeArg(d, &b.ThumbnailCacheMax)
+		case "thumbnail_max_source_size":
+			err = parseSizeArg(d, &b.ThumbnailMaxSize)
+		case "preview_max_size":
+			err = parseSizeArg(d, &b.PreviewMaxSize)
+		case "checksums":
+			err = parseBoolArg(d, &b.Checksums)
+		case "feed_size":
+			err = parseIntArg(d, &b.FeedSize)
+		case "webdav":
+			err = parseBoolArg(d, &b.WebDAV)
+		case "webdav_writable":
+			err = parseBoolArg(d, &b.WebDAVWritable)
+		case "upload":
+			err = parseBoolArg(d, &b.Upload)
+		case "upload_secret":
+			err = parseStringArg(d, &b.UploadSecret)
+		case "upload_max_size":
+			err = parseSizeArg(d, &b.UploadMaxSize)
+		case "upload_extensions":
+			err = parseStringsArg(d, &b.UploadExtensions)
+		case "upload_overwrite":
+			err = parseStringArg(d, &b.UploadOverwrite)
+		case "manage":
+			err = parseBoolArg(d, &b.Manage)
+		case "manage_secret":
+			err = parseStringArg(d, &b.ManageSecret)
+		case "acl":
+			var rule ACLRule
+			rule, err = parseACLRule(d)
+			b.ACL = append(b.ACL, rule)
+		case "acl_group_claim":
+			err = parseStringArg(d, &b.ACLGroupClaim)
+		case "hide":
+			err = parseStringsArg(d, &b.Hide)
+		case "hide_regex":
+			err = parseStringsArg(d, &b.HideRegex)
+		case "hide_listing_only":
+			err = parseBoolArg(d, &b.HideListingOnly)
+		case "hide_ignore_file":
+			err = parseStringArg(d, &b.HideIgnoreFile)
+		case "share":
+			err = parseBoolArg(d, &b.Share)
+		case "share_secret":
+			err = parseStringArg(d, &b.ShareSecret)
+		case "share_max_expiry":
+			err = parseDurationArg(d, &b.ShareMaxExpiry)
+		case "download_stats":
+			err = parseBoolArg(d, &b.DownloadStats)
+		case "download_stats_db":
+			err = parseStringArg(d, &b.DownloadStatsDB)
+		case "download_stats_column":
+			err = parseBoolArg(d, &b.DownloadStatsColumn)
+		case "download_stats_secret":
+			err = parseStringArg(d, &b.DownloadStatsSecret)
+		case "download_stats_ignore_agents":
+			err = parseStringsArg(d, &b.DownloadStatsIgnore)
+		case "versioning":
+			err = parseBoolArg(d, &b.Versioning)
+		case "sse_customer_key":
+			var key SSECustomerKey
+			key, err = parseSSECustomerKey(d)
+			b.SSECustomerKeys = append(b.SSECustomerKeys, key)
+		case "upload_encryption":
+			err = parseStringArg(d, &b.UploadEncryption)
+		case "upload_kms_key_id":
+			err = parseStringArg(d, &b.UploadKMSKeyID)
+		case "backend":
+			err = parseStringArg(d, &b.Backend)
+		case "backend_root":
+			err = parseStringArg(d, &b.BackendRoot)
+		case "requester_pays":
+			err = parseBoolArg(d, &b.RequesterPays)
+		case "s3_header":
+			var name, value string
+			if !d.Args(&name, &value) {
+				err = d.ArgErr()
+				break
+			}
+			if b.S3Headers == nil {
+				b.S3Headers = map[string]string{}
+			}
+			b.S3Headers[name] = value
+		case "health_ready_max_age":
+			err = parseDurationArg(d, &b.HealthReadyMaxAge)
+		case "health_live_max_age":
+			err = parseDurationArg(d, &b.HealthLiveMaxAge)
+		case "health_check_s3":
+			err = parseBoolArg(d, &b.HealthCheckS3)
 		default:
 			err = d.Errf("not a valid s3browser option")
 		}
@@ -112,6 +306,7 @@ func (b *S3Browser) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 func (b *S3Browser) Provision(ctx caddy.Context) (err error) {
 	b.log = ctx.Logger(b)
+	s3browserMetrics.init.Do(initMetrics)
 
 	var s3Sorter *S3FsSorter
 	if b.SortAlgorithm != "" {
@@ -127,36 +322,107 @@ func (b *S3Browser) Provision(ctx caddy.Context) (err error) {
 		}
 	}
 
+	hide, err := newHider(b.Hide, b.HideRegex, b.HideListingOnly, b.HideIgnoreFile)
+	if err != nil {
+		return err
+	}
+
+	b.sse, err = newServerSideEncryption(b.SSECustomerKeys, b.UploadEncryption, b.UploadKMSKeyID)
+	if err != nil {
+		return err
+	}
+	b.s3Header = requestHeader(b.S3Headers, b.RequesterPays)
+	b.s3Health = &s3Health{}
+
 	{
 		b.log.Debug("Initializing S3 Cache")
 		// Manually create the client so we can check the error
-		c, err := NewS3Client(b.Endpoint, b.Key, b.Secret, b.Secure, b.Bucket)
+		c, err := b.newBackend()
 		if err == nil {
-			b.s3Cache = NewS3FsCache(c, s3Sorter, b.log)
-			err = b.s3Cache.Refresh()
+			b.store = c
+			b.s3Cache = NewS3FsCache(c, b.Bucket, s3Sorter, hide, b.log)
+			b.readmeCache = NewReadmeCache(c, b.ReadmeMaxSize, b.log)
+			b.s3Cache.OnRefresh(b.readmeCache.Drop)
+			if b.Checksums {
+				b.checksums = NewChecksumCache(c, b.sse, b.log)
+			}
+			b.refresher = NewRefresher(b.s3Cache, b.RefreshInterval, b.log)
+			// Not fatal, the refresher retries and ?health=ready reports it
+			if result := b.refresher.Refresh(ctx, "/", refreshSourceProvision); result.Error != "" {
+				b.log.Warn("Starting without listing, the first refresh failed", zap.String("error", result.Error))
+			}
 		}
 		if err != nil {
 			return err
 		}
-	}
 
-	b.refreshTrigger = make(chan struct{})
+		if b.Thumbnails {
+			cacheDir := b.ThumbnailCacheDir
+			if cacheDir == "" {
+				cacheDir = filepath.Join(caddy.AppDataDir(), "s3browser", "thumbnails", b.Bucket)
+			}
+			b.thumbnails, err = NewThumbnailCache(c, cacheDir, b.ThumbnailCacheMax, b.ThumbnailMaxSize, b.log)
+			if err != nil {
+				return err
+			}
+		}
+	}
 
-	// Goroutine to trigger cache refresh (periodic/by request)
-	go func() {
-		for {
-			select {
-			case <-b.refreshTrigger:
-				b.log.Debug("refresh", zap.String("source", "api"))
-			case <-time.After(b.RefreshInterval):
-				b.log.Debug("refresh", zap.String("source", "timer"))
+	if b.SignedURLRedirect {
+		b.presignClient = b.store
+		if b.SignedURLBaseURL != "" {
+			b.signedURLBase, err = url.Parse(b.SignedURLBaseURL)
+			if err != nil {
+				return err
 			}
-			err := b.s3Cache.Refresh()
+			presignClient, err := NewS3PresignClient(b.signedURLBase.Host, b.Key, b.Secret,
+				b.signedURLBase.Scheme == "https", b.Bucket, b.Region)
 			if err != nil {
-				b.log.Error("Could not refresh", zap.Error(err))
+				return err
 			}
+			presignClient.SetHeader(b.s3Header)
+			b.presignClient = &presignClient
+		}
+	}
+
+	if len(b.ACL) > 0 {
+		b.acl, err = newAccessControl(b.ACL, b.ACLGroupClaim)
+		if err != nil {
+			return err
 		}
-	}()
+	}
+
+	if b.WebDAV {
+		b.davHandler = newDAVHandler(b.s3Cache, b.s3Client(), b.WebDAVWritable, b.acl, b.UploadMaxSize, b.UploadExtensions, b.log)
+	}
+
+	if b.Share {
+		b.shares, err = NewShareStore(b.ShareSecret, b.ShareMaxExpiry)
+		if err != nil {
+			return err
+		}
+	}
+
+	if b.DownloadStats {
+		dbPath := b.DownloadStatsDB
+		if dbPath == "" {
+			dbPath = filepath.Join(caddy.AppDataDir(), "s3browser", "downloads", b.Bucket+".db")
+		}
+		b.downloads, err = NewDownloadStats(dbPath, b.DownloadStatsIgnore, b.log)
+		if err != nil {
+			return err
+		}
+	}
+
+	if b.Manage || b.Share || b.Upload {
+		b.csrfKey = make([]byte, 32)
+		if _, err := rand.Read(b.csrfKey); err != nil {
+			return err
+		}
+	}
+
+	// Stopped when the config is unloaded
+	go b.refresher.Run(ctx)
 
 	// Prepare template
 	{
@@ -167,8 +433,11 @@ func (b *S3Browser) Provision(ctx caddy.Context) (err error) {
 		}
 
 		// Try to render now to catch any error in template
-		dir, _ := b.s3Cache.GetDir("/")
-		err = b.renderHTML(ioutil.Discard, dir)
+		dir, ok := b.s3Cache.GetDir("/")
+		if !ok {
+			dir = Directory{Path: "/"}
+		}
+		err = b.renderHTML(ctx, ioutil.Discard, dir, layoutList, "test", "test", []DeletedFile{})
 		if err != nil {
 			return err
 		}
@@ -181,29 +450,90 @@ func (b *S3Browser) Validate() error {
 	if b.SiteName == "" {
 		return fmt.Errorf("no sitename")
 	}
-	if b.Endpoint == "" {
-		return fmt.Errorf("no endpoint")
+	switch b.Backend {
+	case "", backendS3:
+		if b.Endpoint == "" {
+			return fmt.Errorf("no endpoint")
+		}
+		if b.Region == "" {
+			return fmt.Errorf("no region")
+		}
+		if b.Key == "" {
+			return fmt.Errorf("no key")
+		}
+		if b.Secret == "" {
+			return fmt.Errorf("no secret")
+		}
+		if b.Bucket == "" {
+			return fmt.Errorf("no bucket")
+		}
+	case backendLocal, backendMemory:
+		if b.Backend == backendLocal && b.BackendRoot == "" {
+			return fmt.Errorf("backend local requires backend_root")
+		}
+		s3Options := []struct {
+			name string
+			set  bool
+		}{
+			{"signed_url_redirect", b.SignedURLRedirect},
+			{"versioning", b.Versioning},
+			{"manage", b.Manage},
+			{"webdav_writable", b.WebDAVWritable},
+			{"sse_customer_key", len(b.SSECustomerKeys) > 0},
+			{"upload_encryption", b.UploadEncryption != ""},
+			{"requester_pays", b.RequesterPays},
+			{"s3_header", len(b.S3Headers) > 0},
+			{"health_check_s3", b.HealthCheckS3},
+		}
+		for _, option := range s3Options {
+			if option.set {
+				return fmt.Errorf("%s requires the s3 backend", option.name)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown backend: %s", b.Backend)
+	}
+	if b.DownloadStatsColumn && !b.DownloadStats {
+		return fmt.Errorf("download_stats_column requires download_stats")
+	}
+	if b.WebDAVWritable && !b.WebDAV {
+		return fmt.Errorf("webdav_writable requires webdav")
+	}
+	if b.SignedURLExpiry > maxSignedURLExpiry {
+		return fmt.Errorf("signed_url_expiry must be at most %s", maxSignedURLExpiry)
+	}
+	switch b.SignedURLDisposition {
+	case "", dispositionInline, dispositionAttachment:
+	default:
+		return fmt.Errorf("unknown signed_url_content_disposition: %s", b.SignedURLDisposition)
 	}
-	if b.Region == "" {
-		return fmt.Errorf("no region")
+	if b.SignedURLBaseURL != "" {
+		u, err := url.Parse(b.SignedURLBaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid signed_url_base_url: %s", b.SignedURLBaseURL)
+		}
 	}
-	if b.Key == "" {
-		return fmt.Errorf("no key")
+	if b.UploadKMSKeyID != "" && b.UploadEncryption != uploadEncryptionKMS {
+		return fmt.Errorf("upload_kms_key_id requires upload_encryption kms")
 	}
-	if b.Secret == "" {
-		return fmt.Errorf("no secret")
+	for name := range b.S3Headers {
+		switch http.CanonicalHeaderKey(name) {
+		case "Authorization", "Host", "X-Amz-Date", "X-Amz-Content-Sha256":
+			return fmt.Errorf("s3_header can't set %s", name)
+		}
 	}
-	if b.Bucket == "" {
-		return fmt.Errorf("no bucket")
+	switch b.UploadOverwrite {
+	case "", overwriteDeny, overwriteAllow, overwriteRename:
+	default:
+		return fmt.Errorf("unknown upload_overwrite: %s", b.UploadOverwrite)
 	}
 	return nil
 }
 
-func (b *S3Browser) newS3Client() S3Client {
-	c, err := NewS3Client(b.Endpoint, b.Key, b.Secret, b.Secure, b.Bucket)
-	if err != nil {
-		// Should never happen because we already validated the params in Provision
-		b.log.Fatal("NewS3Client failed", zap.Error(err))
+// Cleanup releases the resources shared with the next config.
+func (b *S3Browser) Cleanup() error {
+	if b.downloads != nil {
+		return b.downloads.Close()
 	}
-	return c
+	return nil
 }
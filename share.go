@@ -0,0 +1,416 @@
+package s3browser
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Defaults for share links
+const (
+	defaultShareExpiry    = 24 * time.Hour
+	defaultShareMaxExpiry = 30 * 24 * time.Hour
+)
+
+// shareCookiePrefix is followed by the ID of the share link, so several links can be used at once.
+const shareCookiePrefix = "s3browser_share_"
+
+var (
+	errShareInvalid = errors.New("invalid share link")
+	errShareExpired = errors.New("share link expired")
+	errShareUsedUp  = errors.New("share link download limit reached")
+)
+
+// shareToken is the signed content of a share link.
+type shareToken struct {
+	ID        string `json:"i"`
+	Path      string `json:"p"`            // file, or directory shared with everything below it
+	Expires   int64  `json:"e"`            // unix time
+	Password  string `json:"pw,omitempty"` // bcrypt hash, encrypted: the token itself is only signed
+	Downloads int    `json:"n,omitempty"`  // maximum number of downloads, 0 for no limit
+}
+
+type shareCtxKey struct{}
+
+// ShareStore signs and checks share links, and counts their downloads.
+// The counts are kept in memory and reset on restart.
+type ShareStore struct {
+	key       []byte
+	aead      cipher.AEAD // encrypts the password hashes
+	maxExpiry time.Duration
+	lock      sync.Mutex
+	downloads map[string]int // by share ID
+}
+
+type shareRequest struct {
+	Expires   string `json:"expires,omitempty"` // duration, e.g. "72h"
+	Password  string `json:"password,omitempty"`
+	Downloads int    `json:"downloads,omitempty"`
+}
+
+type shareResponse struct {
+	URL     string    `json:"url"`
+	Path    string    `json:"path"`
+	Expires time.Time `json:"expires"`
+}
+
+type SharePasswordArgs struct {
+	SiteName string
+	Name     string
+	Error    string
+}
+
+// NewShareStore uses `secret` to sign the links, a random key is used if it is empty.
+func NewShareStore(secret string, maxExpiry time.Duration) (*ShareStore, error) {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	if maxExpiry <= 0 {
+		maxExpiry = defaultShareMaxExpiry
+	}
+	ss := &ShareStore{key: key, maxExpiry: maxExpiry, downloads: map[string]int{}}
+
+	// A different key than for signing, derived from the same secret
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("share password encryption"))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	if ss.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+func (ss *ShareStore) sign(data string) string {
+	mac := hmac.New(sha256.New, ss.key)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// encode returns the token of a share link: "<payload>.<signature>".
+func (ss *ShareStore) encode(t shareToken) (string, error) {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + ss.sign(payload), nil
+}
+
+// decode checks the signature and the expiry of a token.
+func (ss *ShareStore) decode(token string) (*shareToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(ss.sign(parts[0]))) {
+		return nil, errShareInvalid
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errShareInvalid
+	}
+	var t shareToken
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, errShareInvalid
+	}
+	if time.Now().Unix() > t.Expires {
+		return &t, errShareExpired
+	}
+	if t.Downloads > 0 && ss.used(t.ID) >= t.Downloads {
+		return &t, errShareUsedUp
+	}
+	return &t, nil
+}
+
+// sealPassword encrypts the bcrypt hash of the password of the share link `id`,
+// so it can't be brute-forced offline by whoever has the link.
+func (ss *ShareStore) sealPassword(id string, hash []byte) (string, error) {
+	nonce := make([]byte, ss.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := ss.aead.Seal(nonce, nonce, hash, []byte(id))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// passwordHash decrypts the bcrypt hash of the password of `t`.
+func (ss *ShareStore) passwordHash(t *shareToken) ([]byte, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(t.Password)
+	if err != nil || len(sealed) < ss.aead.NonceSize() {
+		return nil, errShareInvalid
+	}
+	nonce, sealed := sealed[:ss.aead.NonceSize()], sealed[ss.aead.NonceSize():]
+	hash, err := ss.aead.Open(nil, nonce, sealed, []byte(t.ID))
+	if err != nil {
+		return nil, errShareInvalid
+	}
+	return hash, nil
+}
+
+// passwordProof is added to the cookie once the password was checked.
+func (ss *ShareStore) passwordProof(t *shareToken) (string, error) {
+	hash, err := ss.passwordHash(t)
+	if err != nil {
+		return "", err
+	}
+	return ss.sign("password:" + t.ID + ":" + string(hash)), nil
+}
+
+func (ss *ShareStore) used(id string) int {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	return ss.downloads[id]
+}
+
+// countDownload records a download, it fails once the limit is reached.
+func (ss *ShareStore) countDownload(t *shareToken) error {
+	if t.Downloads <= 0 {
+		return nil
+	}
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if ss.downloads[t.ID] >= t.Downloads {
+		return errShareUsedUp
+	}
+	ss.downloads[t.ID]++
+	return nil
+}
+
+// covers checks if the share link gives access to `p`.
+func (t *shareToken) covers(p string) bool {
+	return t.Path == "/" || p == t.Path || strings.HasPrefix(p, t.Path+"/")
+}
+
+// withGrant stores in the request context the share link, from the cookies, giving access to the requested path.
+func (ss *ShareStore) withGrant(r *http.Request) *http.Request {
+	fullPath := normalizePath(r.URL.Path)
+	for _, cookie := range r.Cookies() {
+		if !strings.HasPrefix(cookie.Name, shareCookiePrefix) {
+			continue
+		}
+		value := cookie.Value
+		proof := ""
+		if parts := strings.Split(value, "."); len(parts) == 3 {
+			value, proof = parts[0]+"."+parts[1], parts[2]
+		}
+
+		t, err := ss.decode(value)
+		if err != nil || !t.covers(fullPath) {
+			continue
+		}
+		if t.Password != "" {
+			want, err := ss.passwordProof(t)
+			if err != nil || !hmac.Equal([]byte(proof), []byte(want)) {
+				continue
+			}
+		}
+		return r.WithContext(context.WithValue(r.Context(), shareCtxKey{}, t))
+	}
+	return r
+}
+
+// shareGrant returns the share link giving access to the request, if any.
+func shareGrant(r *http.Request) *shareToken {
+	t, _ := r.Context().Value(shareCtxKey{}).(*shareToken)
+	return t
+}
+
+// countShareDownload counts the download of `filePath` through a share link with a download limit,
+// `kind` is the kind of download of DownloadStats.
+// Only complete downloads and redirects count, not ranges, nor the requests the ACL rules allow without the link.
+// Once the limit is reached, the link no longer gives access (see ShareStore.decode).
+func (b *S3Browser) countShareDownload(r *http.Request, filePath string, kind int) {
+	t := shareGrant(r)
+	if t == nil || t.Downloads <= 0 || r.Method != http.MethodGet || kind == downloadPartial || b.acl == nil {
+		return
+	}
+	s := b.acl.subject(r)
+	s.shared = nil
+	if b.acl.allowed(s, permDownload, filePath) {
+		return
+	}
+	// Concurrent downloads may all complete after the limit is reached
+	_ = b.shares.countDownload(t)
+}
+
+// serveShare handles the `?share` requests:
+//   - POST <path>?share: create a share link for the file or directory, see shareRequest
+//   - GET <path>?share=<token>: open a share link, asks for the password if needed
+//   - POST <path>?share=<token>: check the password of a share link
+func (b *S3Browser) serveShare(w http.ResponseWriter, r *http.Request, token string) error {
+	if token == "" && r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return caddyhttp.Error(http.StatusMethodNotAllowed, nil)
+	}
+	if r.Method == http.MethodPost {
+		if err := checkOrigin(r); err != nil {
+			return err
+		}
+	}
+	if token == "" {
+		return b.createShare(w, r)
+	}
+
+	t, err := b.shares.decode(token)
+	switch err {
+	case nil:
+	case errShareExpired, errShareUsedUp:
+		return caddyhttp.Error(http.StatusGone, err)
+	default:
+		return caddyhttp.Error(http.StatusForbidden, err)
+	}
+
+	value := token
+	if t.Password != "" {
+		args := SharePasswordArgs{SiteName: b.SiteName, Name: t.Path}
+		hash, err := b.shares.passwordHash(t)
+		if err != nil {
+			return caddyhttp.Error(http.StatusForbidden, err)
+		}
+		if r.Method == http.MethodPost {
+			if bcrypt.CompareHashAndPassword(hash, []byte(r.PostFormValue("password"))) == nil {
+				proof, err := b.shares.passwordProof(t)
+				if err != nil {
+					return err
+				}
+				value += "." + proof
+			} else {
+				args.Error = "Wrong password"
+			}
+		}
+		if value == token {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if args.Error != "" {
+				w.WriteHeader(http.StatusForbidden)
+			}
+			return b.template.ExecuteTemplate(w, "share", args)
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareCookiePrefix + t.ID,
+		Value:    value,
+		Path:     t.Path,
+		Expires:  time.Unix(t.Expires, 0),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, (&url.URL{Path: t.Path}).EscapedPath(), http.StatusSeeOther)
+	return nil
+}
+
+func (b *S3Browser) createShare(w http.ResponseWriter, r *http.Request) error {
+	if !authorized(r, b.ManageSecret) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="s3browser"`)
+		return caddyhttp.Error(http.StatusUnauthorized, nil)
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isJSON := mediaType == "application/json"
+	if err := b.checkCSRF(r, isJSON); err != nil {
+		return err
+	}
+
+	fullPath := normalizePath(r.URL.Path)
+	if !b.exists(fullPath) {
+		return caddyhttp.Error(http.StatusNotFound, nil)
+	}
+	if !b.allowed(r, permList, fullPath) || !b.allowed(r, permDownload, fullPath) {
+		return b.denied(r, fullPath)
+	}
+
+	var req shareRequest
+	if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+	} else {
+		req.Expires = r.PostFormValue("expires")
+		req.Password = r.PostFormValue("password")
+		if val := r.PostFormValue("downloads"); val != "" {
+			var err error
+			if req.Downloads, err = strconv.Atoi(val); err != nil {
+				return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid downloads: %q", val))
+			}
+		}
+	}
+
+	expiry := defaultShareExpiry
+	if req.Expires != "" {
+		var err error
+		expiry, err = time.ParseDuration(req.Expires)
+		if err != nil || expiry <= 0 {
+			return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid expires: %q", req.Expires))
+		}
+	}
+	if expiry > b.shares.maxExpiry {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("expires is longer than %s", b.shares.maxExpiry))
+	}
+	if req.Downloads < 0 {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid downloads: %d", req.Downloads))
+	}
+
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	t := shareToken{
+		ID:        hex.EncodeToString(id),
+		Path:      fullPath,
+		Expires:   time.Now().Add(expiry).Unix(),
+		Downloads: req.Downloads,
+	}
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		if t.Password, err = b.shares.sealPassword(t.ID, hash); err != nil {
+			return err
+		}
+	}
+
+	token, err := b.shares.encode(t)
+	if err != nil {
+		return err
+	}
+
+	b.log.Info("share",
+		zap.String("path", fullPath),
+		zap.String("id", t.ID),
+		zap.Time("expires", time.Unix(t.Expires, 0)),
+		zap.Bool("password", t.Password != ""),
+		zap.Int("downloads", t.Downloads),
+		zap.String("user", requestUser(r)),
+		zap.String("remote", r.RemoteAddr))
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return b.writeJSON(w, shareResponse{
+		URL:     requestBaseURL(r) + (&url.URL{Path: fullPath, RawQuery: "share=" + token}).RequestURI(),
+		Path:    fullPath,
+		Expires: time.Unix(t.Expires, 0).UTC(),
+	})
+}
@@ -0,0 +1,251 @@
+package s3browser
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testShareACL denies everything to the clients of httptest.NewRequest, but share links.
+var testShareACL = []ACLRule{{Path: "/**", Deny: []string{permList, permDownload}, IPs: []string{"192.0.2.0/24"}}}
+
+// createTestShare creates a share link of `target` with `req`, it returns the token.
+func createTestShare(t *testing.T, b *S3Browser, target string, req string) string {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com"+target+"?share", strings.NewReader(req))
+	r.Header.Set("Content-Type", "application/json")
+	r.SetBasicAuth("admin", testManageSecret)
+	r.RemoteAddr = "10.0.0.1:1234" // not denied by testShareACL
+	w, err := serve(b, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp shareResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(resp.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query().Get("share")
+}
+
+// openTestShare opens the share link and returns its cookie, nil if none was set.
+func openTestShare(t *testing.T, b *S3Browser, target string, token string, password string) *http.Cookie {
+	t.Helper()
+
+	method, body := http.MethodGet, ""
+	if password != "" {
+		method, body = http.MethodPost, url.Values{"password": {password}}.Encode()
+	}
+	r := httptest.NewRequest(method, "http://example.com"+target+"?share="+token, strings.NewReader(body))
+	if password != "" {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w, err := serve(b, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 {
+		return nil
+	}
+	return cookies[0]
+}
+
+func TestSharePassword(t *testing.T) {
+	b := newTestBrowser(t, &S3Browser{Share: true, ManageSecret: testManageSecret, ACL: testShareACL})
+	token := createTestShare(t, b, "/docs", `{"password": "hunter2"}`)
+
+	// The hash can't be read from the link
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(payload), "$2a$") {
+		t.Errorf("the password hash is in the token: %s", payload)
+	}
+
+	if cookie := openTestShare(t, b, "/docs", token, ""); cookie != nil {
+		t.Error("opened without the password")
+	}
+	if cookie := openTestShare(t, b, "/docs", token, "wrong"); cookie != nil {
+		t.Error("opened with a wrong password")
+	}
+	cookie := openTestShare(t, b, "/docs", token, "hunter2")
+	if cookie == nil {
+		t.Fatal("not opened with the password")
+	}
+
+	download := func(cookie *http.Cookie) error {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/docs/guide.txt", nil)
+		r.AddCookie(cookie)
+		_, err := serve(b, r)
+		return err
+	}
+	if err := download(cookie); err != nil {
+		t.Errorf("download with the cookie: %v", err)
+	}
+	if err := download(&http.Cookie{Name: cookie.Name, Value: token}); err == nil {
+		t.Error("download without the proof of the password")
+	}
+
+	// The proof is bound to the password, not only to the ID of the link
+	proofOf := func(hash string) string {
+		sealed, err := b.shares.sealPassword("id", []byte(hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err := b.shares.passwordProof(&shareToken{ID: "id", Password: sealed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proof
+	}
+	if proofOf("hash1") == proofOf("hash2") {
+		t.Error("the proof doesn't depend on the password hash")
+	}
+}
+
+func TestShareDownloadLimit(t *testing.T) {
+	b := newTestBrowser(t, &S3Browser{Share: true, ManageSecret: testManageSecret, ACL: testShareACL})
+	cookie := openTestShare(t, b, "/docs", createTestShare(t, b, "/docs", `{"downloads": 2}`), "")
+
+	download := func(remoteAddr string, rangeHdr string) error {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/docs/guide.txt", nil)
+		r.RemoteAddr = remoteAddr
+		r.AddCookie(cookie)
+		if rangeHdr != "" {
+			r.Header.Set("Range", rangeHdr)
+		}
+		_, err := serve(b, r)
+		return err
+	}
+
+	// Ranges, and clients the ACL allows anyway, are not counted
+	for i := 0; i < 5; i++ {
+		if err := download("192.0.2.1:1234", "bytes=0-3"); err != nil {
+			t.Fatalf("range %d: %v", i, err)
+		}
+		if err := download("10.0.0.1:1234", ""); err != nil {
+			t.Fatalf("allowed download %d: %v", i, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := download("192.0.2.1:1234", ""); err != nil {
+			t.Fatalf("download %d: %v", i, err)
+		}
+	}
+	if err := download("192.0.2.1:1234", ""); err == nil {
+		t.Error("downloaded after the limit")
+	}
+	if err := download("10.0.0.1:1234", ""); err != nil {
+		t.Errorf("the limit applies to clients allowed by the ACL: %v", err)
+	}
+}
+
+func TestShareToken(t *testing.T) {
+	ss, err := NewShareStore("secret", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewShareStore("other secret", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour).Unix()
+	valid, err := ss.encode(shareToken{ID: "valid", Path: "/docs", Expires: future, Downloads: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _ := ss.encode(shareToken{ID: "expired", Path: "/docs", Expires: time.Now().Add(-time.Second).Unix()})
+	usedUp, _ := ss.encode(shareToken{ID: "used", Path: "/docs", Expires: future, Downloads: 2})
+	ss.countDownload(&shareToken{ID: "used", Downloads: 2})
+	ss.countDownload(&shareToken{ID: "used", Downloads: 2})
+	foreign, _ := other.encode(shareToken{ID: "foreign", Path: "/", Expires: future})
+
+	payload, signature := valid[:strings.Index(valid, ".")], valid[strings.Index(valid, ".")+1:]
+	data, _ := base64.RawURLEncoding.DecodeString(payload)
+	widened := base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(data), `"/docs"`, `"/"`, 1)))
+	flipped := []byte(signature)
+	flipped[0] ^= 1
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid", valid, nil},
+		{"expired", expired, errShareExpired},
+		{"used up", usedUp, errShareUsedUp},
+		{"other key", foreign, errShareInvalid},
+		{"tampered payload", widened + "." + signature, errShareInvalid},
+		{"tampered signature", payload + "." + string(flipped), errShareInvalid},
+		{"no signature", payload, errShareInvalid},
+		{"empty signature", payload + ".", errShareInvalid},
+		{"extra part", valid + ".x", errShareInvalid},
+		{"not base64", "!!!." + ss.sign("!!!"), errShareInvalid},
+		{"not json", "bm90IGpzb24." + ss.sign("bm90IGpzb24"), errShareInvalid},
+		{"empty", "", errShareInvalid},
+	}
+	for _, tt := range tests {
+		decoded, err := ss.decode(tt.token)
+		if err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+		if err == nil && (decoded.ID != "valid" || decoded.Path != "/docs" || decoded.Expires != future || decoded.Downloads != 1) {
+			t.Errorf("%s: decoded %+v", tt.name, decoded)
+		}
+	}
+
+	// The download limit
+	tok, _ := ss.decode(valid)
+	if err := ss.countDownload(tok); err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.countDownload(tok); err != errShareUsedUp {
+		t.Errorf("second download: got %v", err)
+	}
+	if _, err := ss.decode(valid); err != errShareUsedUp {
+		t.Errorf("decode after the limit: got %v", err)
+	}
+	unlimited := &shareToken{ID: "unlimited"}
+	for i := 0; i < 3; i++ {
+		if err := ss.countDownload(unlimited); err != nil {
+			t.Errorf("without limit: %v", err)
+		}
+	}
+}
+
+func TestShareTokenCovers(t *testing.T) {
+	tests := []struct {
+		shared string
+		path   string
+		want   bool
+	}{
+		{"/a", "/a", true},
+		{"/a", "/a/b", true},
+		{"/a", "/a/b/c.txt", true},
+		{"/a", "/ab", false},
+		{"/a", "/ab/c", false},
+		{"/a", "/", false},
+		{"/a/b.txt", "/a/b.txt", true},
+		{"/a/b.txt", "/a/b.txt.sha256", false},
+		{"/a/b.txt", "/a", false},
+		{"/", "/", true},
+		{"/", "/anything/below", true},
+	}
+	for _, tt := range tests {
+		tok := &shareToken{Path: tt.shared}
+		if got := tok.covers(tt.path); got != tt.want {
+			t.Errorf("link to %s covers(%s) = %v, want %v", tt.shared, tt.path, got, tt.want)
+		}
+	}
+}
@@ -6,9 +6,30 @@ import (
 	"strings"
 )
 
+// Values for TemplateArgs.Layout
+const (
+	layoutList = "list"
+	layoutGrid = "grid"
+)
+
 type TemplateArgs struct {
-	SiteName string
-	Dir      Directory
+	SiteName    string
+	Dir         Directory
+	Header      template.HTML    // rendered HEADER file, displayed above the listing
+	Readme      template.HTML    // rendered README file, displayed below the listing
+	Layout      string           // layoutList or layoutGrid
+	Thumbnails  bool             // whether `?thumbnail` is available
+	Upload      bool             // whether uploads are enabled
+	UploadToken string           // set when the user may upload, the drop zone is displayed
+	Resumable   bool             // whether large files are uploaded in parts, with the s3 backend
+	Manage      bool             // whether management actions are enabled
+	Share       bool             // whether share links are enabled
+	CSRFToken   string           // set when the user may manage files, the actions are displayed
+	Downloads   bool             // whether the download counts column is displayed
+	Counts      map[string]int64 // download counts of the files
+	Versioning  bool             // whether previous versions can be browsed
+	Deleted     []DeletedFile    // deleted files, listed with `?deleted`
+	ShowDeleted bool             // whether `?deleted` was requested
 }
 
 type Crumb struct {
@@ -19,11 +40,26 @@ type Crumb struct {
 func parseTemplate() (*template.Template, error) {
 	funcs := template.FuncMap{
 		"Breadcrumbs": breadcrumbs,
+		"IsImage":     isImage,
 		"PathBase":    path.Base,
 		"PathDir":     path.Dir,
 		"PathJoin":    path.Join,
+		"VersionLink": versionLink,
+	}
+	t, err := template.New("listing").Funcs(funcs).Parse(defaultTemplate)
+	if err == nil {
+		_, err = t.New("style").Parse(defaultStyle)
+	}
+	if err == nil {
+		_, err = t.New("preview").Parse(previewTemplate)
+	}
+	if err == nil {
+		_, err = t.New("share").Parse(shareTemplate)
 	}
-	return template.New("listing").Funcs(funcs).Parse(defaultTemplate)
+	if err == nil {
+		_, err = t.New("versions").Parse(versionsTemplate)
+	}
+	return t, err
 }
 
 func breadcrumbs(args TemplateArgs) []Crumb {
@@ -52,7 +88,435 @@ const defaultTemplate = `<!DOCTYPE html>
 		<title>{{ if ne .Dir.Path "/" }}{{ PathBase .Dir.Path }} | {{ end }}{{ .SiteName }}</title>
 		<meta charset="utf-8">
 		<meta name="viewport" content="width=device-width, initial-scale=1.0">
-<style>
+		<link rel="alternate" type="application/atom+xml" title="Recent files (Atom)" href="?format=atom">
+		<link rel="alternate" type="application/rss+xml" title="Recent files (RSS)" href="?format=rss">
+{{ template "style" }}
+<!-- template source from https://github.com/caddyserver/caddy/blob/a2d71bdd94c0ca51dfb3b816b61911dac799581f/caddyhttp/browse/setup.go -->
+	</head>
+	<body>
+		<svg version="1.1" xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" height="0" width="0" style="position: absolute;">
+			<defs>
+				<!-- Folder -->
+				<g id="folder" fill-rule="nonzero" fill="none">
+					<path d="M285.22 37.55h-142.6L110.9 0H31.7C14.25 0 0 16.9 0 37.55v75.1h316.92V75.1c0-20.65-14.26-37.55-31.7-37.55z" fill="#FFA000"/>
+					<path d="M285.22 36H31.7C14.25 36 0 50.28 0 67.74v158.7c0 17.47 14.26 31.75 31.7 31.75H285.2c17.44 0 31.7-14.3 31.7-31.75V67.75c0-17.47-14.26-31.75-31.7-31.75z" fill="#FFCA28"/>
+				</g>
+				<!-- File -->
+				<g id="file" stroke="#000" stroke-width="25" fill="#FFF" fill-rule="evenodd" stroke-linecap="round" stroke-linejoin="round">
+					<path d="M13 24.12v274.76c0 6.16 5.87 11.12 13.17 11.12H239c7.3 0 13.17-4.96 13.17-11.12V136.15S132.6 13 128.37 13H26.17C18.87 13 13 17.96 13 24.12z"/>
+					<path d="M129.37 13L129 113.9c0 10.58 7.26 19.1 16.27 19.1H249L129.37 13z"/>
+				</g>
+			</defs>
+		</svg>
+		<header>
+			<h1>
+				{{ range $_, $crumb := Breadcrumbs $ }}
+					<a href="{{ html $crumb.Link }}">{{ html $crumb.Name }}</a> /
+				{{ end }}
+			</h1>
+			{{- if .Thumbnails }}
+			<div class="layout">
+				<a href="?layout=list"{{ if eq .Layout "list" }} class="active"{{ end }}>List</a> |
+				<a href="?layout=grid"{{ if eq .Layout "grid" }} class="active"{{ end }}>Gallery</a>
+			</div>
+			{{- end }}
+			{{- if .Versioning }}
+			<div class="layout">
+			{{- if .ShowDeleted }}
+				<a href="?" class="active">Hide deleted files</a>
+			{{- else }}
+				<a href="?deleted">Show deleted files</a>
+			{{- end }}
+			</div>
+			{{- end }}
+			{{- if and .Manage .CSRFToken }}
+			<form class="manage mkdir" method="post" action="{{ html .Dir.Path }}?manage=mkdir">
+				<input type="hidden" name="csrf" value="{{ .CSRFToken }}">
+				<input type="text" name="name" placeholder="New folder" required>
+				<button type="submit">Create</button>
+			</form>
+			{{- else if and (or .Manage .Share) (not .CSRFToken) }}
+			<div class="layout"><a href="?manage=login">Log in</a></div>
+			{{- end }}
+		</header>
+		<main>
+			{{- if .Header }}
+			<div class="readme header">
+				{{ .Header }}
+			</div>
+			{{- end }}
+			{{- if eq .Layout "grid" }}
+			<div class="gallery">
+				{{ if ne .Dir.Path "/" }}
+				<figure>
+					<a href="{{ html (PathDir .Dir.Path) }}?layout=grid">
+						<div class="thumb"><span class="goup">Go up</span></div>
+					</a>
+				</figure>
+				{{- end}}
+				{{ range $name := .Dir.Folders }}
+				<figure>
+					<a href="{{ html (PathJoin $.Dir.Path $name) }}?layout=grid">
+						<div class="thumb"><svg width="96" height="96" version="1.1" viewBox="0 0 317 259"><use xlink:href="#folder"></use></svg></div>
+						<figcaption>{{ html $name }}</figcaption>
+					</a>
+				</figure>
+				{{ end }}
+				{{ range $name := .Dir.Filenames }}
+				{{ $info := $.Dir.GetFile $name }}
+				<figure>
+					<a href="{{ html (PathJoin $.Dir.Path $name) }}">
+						<div class="thumb">
+						{{- if IsImage $name }}
+							<img loading="lazy" src="{{ html (PathJoin $.Dir.Path $name) }}?thumbnail" alt="{{ html $name }}">
+						{{- else }}
+							<svg width="96" height="96" version="1.1" viewBox="0 0 265 323"><use xlink:href="#file"></use></svg>
+						{{- end }}
+						</div>
+						<figcaption>{{ html $name }} ({{ $info.HumanSize }})</figcaption>
+					</a>
+				</figure>
+				{{- end}}
+			</div>
+			{{- else }}
+			<div class="listing">
+				<table aria-describedby="summary">
+					<thead>
+					<tr>
+						<th></th>
+						<th>
+							Name
+						</th>
+						<th>
+							Size
+						</th>
+						<th class="hideable">
+							Modified
+						</th>
+						{{- if .Downloads }}
+						<th class="hideable">
+							Downloads
+						</th>
+						{{- end }}
+						<th class="hideable"></th>
+					</tr>
+					</thead>
+					<tbody>
+					{{ if ne .Dir.Path "/" }}
+					<tr>
+						<td></td>
+						<td>
+							<a href="{{ html (PathDir .Dir.Path) }}">
+								<span class="goup">Go up</span>
+							</a>
+						</td>
+						<td>&mdash;</td>
+						<td class="hideable">&mdash;</td>
+						{{- if .Downloads }}
+						<td class="hideable">&mdash;</td>
+						{{- end }}
+						<td class="hideable"></td>
+					</tr>
+					{{- end}}
+					{{ range $name := .Dir.Folders }}
+						<tr class="file">
+							<td></td>
+							<td>
+								<a href="{{ html (PathJoin $.Dir.Path $name) }}">
+									<svg width="1.5em" height="1em" version="1.1" viewBox="0 0 317 259"><use xlink:href="#folder"></use></svg>
+									<span class="name">{{ html $name }}</span>
+								</a>
+							</td>
+							<td>&mdash;</td>
+							<td class="hideable">&mdash;</td>
+							{{- if $.Downloads }}
+							<td class="hideable">&mdash;</td>
+							{{- end }}
+							<td class="hideable">
+							{{- if and $.Share $.CSRFToken }}
+								<form class="manage" method="post" action="{{ html (PathJoin $.Dir.Path $name) }}?share" data-share>
+									<input type="hidden" name="csrf" value="{{ $.CSRFToken }}">
+									<button type="submit">Share</button>
+								</form>
+							{{- end }}
+							{{- if and $.Manage $.CSRFToken }}
+								<form class="manage" method="post" action="{{ html (PathJoin $.Dir.Path $name) }}?manage=rename" data-rename="{{ $name }}">
+									<input type="hidden" name="csrf" value="{{ $.CSRFToken }}">
+									<input type="hidden" name="to">
+									<button type="submit">Rename</button>
+								</form>
+								<form class="manage" method="post" action="{{ html (PathJoin $.Dir.Path $name) }}?manage=delete" data-confirm="Delete the folder {{ $name }} and everything in it?">
+									<input type="hidden" name="csrf" value="{{ $.CSRFToken }}">
+									<button type="submit">Delete</button>
+								</form>
+							{{- end }}
+							</td>
+						</tr>
+					{{ end }}
+					{{ range $name := .Dir.Filenames }}
+						{{ $info := $.Dir.GetFile $name }}
+						<tr class="file">
+							<td></td>
+							<td>
+								<a href="{{ html (PathJoin $.Dir.Path $name) }}">
+									<svg width="1.5em" height="1em" version="1.1" viewBox="0 0 265 323"><use xlink:href="#file"></use></svg>
+									<span class="name">{{html $name}}</span>
+								</a>
+							</td>
+							<td>{{ $info.HumanSize }}</td>
+							<td class="hideable"><time datetime="{{ $info.HumanModTime "2006-01-02T15:04:05Z" }}">{{ $info.HumanModTime "01/02/2006 03:04:05 PM -07:00" }}</time></td>
+							{{- if $.Downloads }}
+							<td class="hideable">{{ index $.Counts $name }}</td>
+							{{- end }}
+							<td class="hideable">
+								<a href="{{ html (PathJoin $.Dir.Path $name) }}?preview">Preview</a>
+							{{- if $.Versioning }}
+								<a href="{{ html (PathJoin $.Dir.Path $name) }}?versions">Versions</a>
+							{{- end }}
+							{{- if and $.Share $.CSRFToken }}
+								<form class="manage" method="post" action="{{ html (PathJoin $.Dir.Path $name) }}?share" data-share>
+									<input type="hidden" name="csrf" value="{{ $.CSRFToken }}">
+									<button type="submit">Share</button>
+								</form>
+							{{- end }}
+							{{- if and $.Manage $.CSRFToken }}
+								<form class="manage" method="post" action="{{ html (PathJoin $.Dir.Path $name) }}?manage=rename" data-rename="{{ $name }}">
+									<input type="hidden" name="csrf" value="{{ $.CSRFToken }}">
+									<input type="hidden" name="to">
+									<button type="submit">Rename</button>
+								</form>
+								<form class="manage" method="post" action="{{ html (PathJoin $.Dir.Path $name) }}?manage=delete" data-confirm="Delete {{ $name }}?">
+									<input type="hidden" name="csrf" value="{{ $.CSRFToken }}">
+									<button type="submit">Delete</button>
+								</form>
+							{{- end }}
+							</td>
+						</tr>
+					{{- end}}
+					{{ range $file := .Deleted }}
+						<tr class="file deleted">
+							<td></td>
+							<td>
+								<a href="{{ html (PathJoin $.Dir.Path $file.Name) }}?versions">
+									<svg width="1.5em" height="1em" version="1.1" viewBox="0 0 265 323"><use xlink:href="#file"></use></svg>
+									<span class="name">{{ html $file.Name }}</span>
+								</a>
+							</td>
+							<td>&mdash;</td>
+							<td class="hideable"><time datetime="{{ $file.Date.Format "2006-01-02T15:04:05Z" }}">{{ $file.Date.Format "01/02/2006 03:04:05 PM -07:00" }}</time></td>
+							{{- if $.Downloads }}
+							<td class="hideable">&mdash;</td>
+							{{- end }}
+							<td class="hideable">
+								<a href="{{ html (PathJoin $.Dir.Path $file.Name) }}?versions">Versions</a>
+							</td>
+						</tr>
+					{{- end}}
+					</tbody>
+				</table>
+			</div>
+			{{- end }}
+			{{- if .UploadToken }}
+			<div id="upload" class="upload">
+				<label>
+					Drop files here or <span class="browse">browse</span>
+					<input type="file" multiple>
+				</label>
+				<ul class="status"></ul>
+			</div>
+			{{- else if .Upload }}
+			<div class="layout"><a href="?upload=login">Log in to upload</a></div>
+			{{- end }}
+			{{- if .Readme }}
+			<div class="readme">
+				{{ .Readme }}
+			</div>
+			{{- end }}
+		</main>
+		<footer>
+			Served by S3 Browser via <a rel="noopener noreferrer" href="https://caddyserver.com">Caddy</a>
+		</footer>
+		{{- if .CSRFToken }}
+		<script>
+		(function() {
+			document.querySelectorAll('form[data-confirm]').forEach(function(form) {
+				form.addEventListener('submit', function(e) {
+					if (!confirm(form.dataset.confirm)) {
+						e.preventDefault();
+					}
+				});
+			});
+			// The new name can also be an absolute path to move the file
+			document.querySelectorAll('form[data-rename]').forEach(function(form) {
+				form.addEventListener('submit', function(e) {
+					var to = prompt('New name (or /path/to/new/name):', form.dataset.rename);
+					if (!to || to === form.dataset.rename) {
+						e.preventDefault();
+						return;
+					}
+					form.elements.to.value = to;
+				});
+			});
+			document.querySelectorAll('form[data-share]').forEach(function(form) {
+				form.addEventListener('submit', function(e) {
+					e.preventDefault();
+					var expires = prompt('Link valid for (e.g. 24h, 168h):', '24h');
+					if (!expires) {
+						return;
+					}
+					var data = new URLSearchParams(new FormData(form));
+					data.set('expires', expires);
+					data.set('password', prompt('Password (optional):', '') || '');
+					data.set('downloads', prompt('Maximum number of downloads (0 for no limit):', '0') || '0');
+					fetch(form.action, {method: 'POST', body: data, credentials: 'same-origin'})
+						.then(function(resp) {
+							if (!resp.ok) {
+								throw new Error(resp.status + ' ' + resp.statusText);
+							}
+							return resp.json();
+						})
+						.then(function(share) {
+							prompt('Share link, valid until ' + new Date(share.expires).toLocaleString() + ':', share.url);
+						})
+						.catch(function(err) {
+							alert('Could not create the link: ' + err.message);
+						});
+				});
+			});
+		})();
+		</script>
+		{{- end }}
+		{{- if .UploadToken }}
+		<script>
+		(function() {
+			var token = {{ .UploadToken }};
+			var zone = document.getElementById('upload');
+			var input = zone.querySelector('input');
+			var statusList = zone.querySelector('.status');
+			var dir = location.pathname.replace(/\/?$/, '/');
+
+			function request(method, url, body, onprogress) {
+				return new Promise(function(resolve, reject) {
+					var xhr = new XMLHttpRequest();
+					xhr.open(method, url);
+					xhr.setRequestHeader('X-CSRF-Token', token);
+					xhr.responseType = 'json';
+					if (onprogress) {
+						xhr.upload.onprogress = onprogress;
+					}
+					xhr.onload = function() {
+						if (xhr.status >= 200 && xhr.status < 300) {
+							resolve(xhr.response);
+						} else {
+							reject(new Error(xhr.status + ' ' + xhr.statusText));
+						}
+					};
+					xhr.onerror = function() {
+						reject(new Error('network error'));
+					};
+					xhr.send(body);
+				});
+			}
+
+			function encodePath(p) {
+				return p.split('/').map(encodeURIComponent).join('/');
+			}
+
+			// Small files are sent in a single form upload
+			function uploadForm(file, report) {
+				var form = new FormData();
+				form.append('file', file);
+				return request('POST', encodePath(dir) + '?upload', form, function(e) {
+					report(e.loaded / e.total);
+				});
+			}
+
+			// Large files are sent part by part, the upload resumes
+			// where it stopped if the same file is dropped again.
+			async function uploadParts(file, partSize, report) {
+				var key = 's3browser-upload:' + dir + file.name + ':' + file.size + ':' + file.lastModified;
+				var state = JSON.parse(localStorage.getItem(key) || 'null');
+				var done = {};
+				if (state) {
+					try {
+						var status = await request('GET', encodePath(state.path) + '?upload=status&uploadId=' + encodeURIComponent(state.uploadId));
+						status.parts.forEach(function(p) { done[p.part] = true; });
+					} catch (e) {
+						state = null;
+					}
+				}
+				if (!state) {
+					state = await request('POST', encodePath(dir + file.name) + '?upload=init&size=' + file.size);
+					localStorage.setItem(key, JSON.stringify(state));
+				}
+
+				var base = encodePath(state.path) + '?uploadId=' + encodeURIComponent(state.uploadId);
+				var count = Math.max(1, Math.ceil(file.size / state.partSize));
+				for (var n = 1; n <= count; n++) {
+					if (!done[n]) {
+						var start = (n - 1) * state.partSize;
+						var chunk = file.slice(start, Math.min(start + state.partSize, file.size));
+						await request('PUT', base + '&upload=part&part=' + n, chunk, function(e) {
+							report((start + e.loaded) / file.size);
+						});
+					}
+				}
+				var result = await request('POST', base + '&upload=complete');
+				localStorage.removeItem(key);
+				return result;
+			}
+
+			async function upload(files) {
+				var partSize = 16 * 1024 * 1024;
+				var failed = false;
+				for (var i = 0; i < files.length; i++) {
+					var file = files[i];
+					var item = document.createElement('li');
+					item.textContent = file.name;
+					statusList.appendChild(item);
+					var report = function(ratio) {
+						item.textContent = file.name + ' ' + Math.floor(ratio * 100) + '%';
+					};
+					try {
+						if (file.size <= partSize || !{{ .Resumable }}) {
+							await uploadForm(file, report);
+						} else {
+							await uploadParts(file, partSize, report);
+						}
+						item.textContent = file.name + ' done';
+					} catch (e) {
+						failed = true;
+						item.textContent = file.name + ' failed: ' + e.message;
+						item.className = 'error';
+					}
+				}
+				if (!failed) {
+					location.reload();
+				}
+			}
+
+			input.addEventListener('change', function() {
+				upload(input.files);
+			});
+			zone.addEventListener('dragover', function(e) {
+				e.preventDefault();
+				zone.classList.add('dragging');
+			});
+			zone.addEventListener('dragleave', function() {
+				zone.classList.remove('dragging');
+			});
+			zone.addEventListener('drop', function(e) {
+				e.preventDefault();
+				zone.classList.remove('dragging');
+				upload(e.dataTransfer.files);
+			});
+		})();
+		</script>
+		{{- end }}
+	</body>
+</html>`
+
+const defaultStyle = `<style>
 * { padding: 0; margin: 0; }
 body {
 	font-family: sans-serif;
@@ -191,6 +655,151 @@ td .goup {
 	bottom: -1px;
 	left: 0;
 }
+.readme {
+	max-width: 800px;
+	margin: 0 auto;
+	padding: 20px;
+	font-size: 14px;
+	line-height: 1.5;
+}
+.readme pre {
+	white-space: pre-wrap;
+	overflow-wrap: break-word;
+}
+.readme img {
+	max-width: 100%;
+}
+.layout {
+	float: right;
+	font-size: 14px;
+	margin-top: -2.5em;
+}
+.layout a.active {
+	font-weight: bold;
+}
+.gallery {
+	display: flex;
+	flex-wrap: wrap;
+	gap: 10px;
+}
+.gallery figure {
+	width: 200px;
+	margin: 0;
+	text-align: center;
+	font-size: 14px;
+}
+.gallery figure .thumb {
+	display: flex;
+	align-items: center;
+	justify-content: center;
+	height: 200px;
+	background-color: #f2f2f2;
+}
+.gallery figure img {
+	max-width: 100%;
+	max-height: 100%;
+}
+.gallery figcaption {
+	word-break: break-all;
+	overflow-wrap: break-word;
+	padding: 5px;
+}
+.preview {
+	padding: 20px;
+}
+.preview .meta {
+	font-size: 14px;
+	margin-bottom: 20px;
+}
+.preview .meta .download {
+	margin-left: 20px;
+	padding: 5px 10px;
+	border: 1px solid #006ed3;
+	border-radius: 3px;
+}
+.preview .content img,
+.preview .content video {
+	max-width: 100%;
+	max-height: 80vh;
+}
+.preview .content audio {
+	width: 100%;
+}
+.preview .content iframe {
+	width: 100%;
+	height: 80vh;
+	border: none;
+}
+.preview .content pre {
+	font-size: 13px;
+	overflow-x: auto;
+}
+.deleted .name {
+	color: #999;
+	text-decoration: line-through;
+}
+.versions {
+	padding: 20px;
+}
+.versions td.latest {
+	font-weight: bold;
+}
+.preview .truncated {
+	font-size: 14px;
+	font-style: italic;
+	margin-top: 10px;
+}
+form.manage {
+	display: inline;
+	margin-left: 5px;
+}
+form.manage button {
+	font-size: 12px;
+	cursor: pointer;
+}
+main.share {
+	padding: 20px;
+	font-size: 14px;
+}
+main.share .error {
+	color: #d00;
+}
+main.share p {
+	margin-bottom: 10px;
+}
+form.mkdir {
+	display: block;
+	margin-top: 10px;
+	font-size: 14px;
+}
+.upload {
+	margin: 20px;
+	padding: 20px;
+	border: 2px dashed #ccc;
+	border-radius: 5px;
+	text-align: center;
+	font-size: 14px;
+}
+.upload.dragging {
+	border-color: #006ed3;
+	background-color: #f0f7ff;
+}
+.upload label {
+	cursor: pointer;
+}
+.upload .browse {
+	color: #006ed3;
+}
+.upload input {
+	display: none;
+}
+.upload .status {
+	list-style: none;
+	margin-top: 10px;
+}
+.upload .status .error {
+	color: #d00;
+}
 footer {
 	padding: 40px 20px;
 	font-size: 12px;
@@ -218,94 +827,52 @@ footer {
 		max-width: 100px;
 	}
 }
-</style>
-<!-- template source from https://github.com/caddyserver/caddy/blob/a2d71bdd94c0ca51dfb3b816b61911dac799581f/caddyhttp/browse/setup.go -->
+</style>`
+
+const previewTemplate = `<!DOCTYPE html>
+<html>
+	<head>
+		<title>{{ .Name }} | {{ .SiteName }}</title>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+{{ template "style" }}
 	</head>
 	<body>
-		<svg version="1.1" xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" height="0" width="0" style="position: absolute;">
-			<defs>
-				<!-- Folder -->
-				<g id="folder" fill-rule="nonzero" fill="none">
-					<path d="M285.22 37.55h-142.6L110.9 0H31.7C14.25 0 0 16.9 0 37.55v75.1h316.92V75.1c0-20.65-14.26-37.55-31.7-37.55z" fill="#FFA000"/>
-					<path d="M285.22 36H31.7C14.25 36 0 50.28 0 67.74v158.7c0 17.47 14.26 31.75 31.7 31.75H285.2c17.44 0 31.7-14.3 31.7-31.75V67.75c0-17.47-14.26-31.75-31.7-31.75z" fill="#FFCA28"/>
-				</g>
-				<!-- File -->
-				<g id="file" stroke="#000" stroke-width="25" fill="#FFF" fill-rule="evenodd" stroke-linecap="round" stroke-linejoin="round">
-					<path d="M13 24.12v274.76c0 6.16 5.87 11.12 13.17 11.12H239c7.3 0 13.17-4.96 13.17-11.12V136.15S132.6 13 128.37 13H26.17C18.87 13 13 17.96 13 24.12z"/>
-					<path d="M129.37 13L129 113.9c0 10.58 7.26 19.1 16.27 19.1H249L129.37 13z"/>
-				</g>
-			</defs>
-		</svg>
 		<header>
 			<h1>
-				{{ range $_, $crumb := Breadcrumbs $ }}
+				{{ range $_, $crumb := Breadcrumbs $.TemplateArgs }}
 					<a href="{{ html $crumb.Link }}">{{ html $crumb.Name }}</a> /
 				{{ end }}
+				{{ html .Name }}
 			</h1>
 		</header>
-		<main>
-			<div class="listing">
-				<table aria-describedby="summary">
-					<thead>
-					<tr>
-						<th></th>
-						<th>
-							Name
-						</th>
-						<th>
-							Size
-						</th>
-						<th class="hideable">
-							Modified
-						</th>
-						<th class="hideable"></th>
-					</tr>
-					</thead>
-					<tbody>
-					{{ if ne .Dir.Path "/" }}
-					<tr>
-						<td></td>
-						<td>
-							<a href="{{ html (PathDir .Dir.Path) }}">
-								<span class="goup">Go up</span>
-							</a>
-						</td>
-						<td>&mdash;</td>
-						<td class="hideable">&mdash;</td>
-						<td class="hideable"></td>
-					</tr>
-					{{- end}}
-					{{ range $name := .Dir.Folders }}
-						<tr class="file">
-							<td></td>
-							<td>
-								<a href="{{ html (PathJoin $.Dir.Path $name) }}">
-									<svg width="1.5em" height="1em" version="1.1" viewBox="0 0 317 259"><use xlink:href="#folder"></use></svg>
-									<span class="name">{{ html $name }}</span>
-								</a>
-							</td>
-							<td>&mdash;</td>
-							<td class="hideable">&mdash;</td>
-							<td class="hideable"></td>
-						</tr>
-					{{ end }}
-					{{ range $name := .Dir.Filenames }}
-						{{ $info := $.Dir.GetFile $name }}
-						<tr class="file">
-							<td></td>
-							<td>
-								<a href="{{ html (PathJoin $.Dir.Path $name) }}">
-									<svg width="1.5em" height="1em" version="1.1" viewBox="0 0 265 323"><use xlink:href="#file"></use></svg>
-									<span class="name">{{html $name}}</span>
-								</a>
-							</td>
-							<td>{{ $info.HumanSize }}</td>
-							<td class="hideable"><time datetime="{{ $info.HumanModTime "2006-01-02T15:04:05Z" }}">{{ $info.HumanModTime "01/02/2006 03:04:05 PM -07:00" }}</time></td>
-							<td class="hideable"></td>
-						</tr>
-					{{- end}}
-					</tbody>
-				</table>
+		<main class="preview">
+			<div class="meta">
+				{{ .File.HumanSize }} &mdash;
+				<time datetime="{{ .File.HumanModTime "2006-01-02T15:04:05Z" }}">{{ .File.HumanModTime "01/02/2006 03:04:05 PM -07:00" }}</time>
+				<a class="download" href="{{ html .Link }}" download>Download</a>
+			</div>
+			<div class="content">
+			{{- if eq .Kind "image" }}
+				<img src="{{ html .Link }}" alt="{{ html .Name }}">
+			{{- else if eq .Kind "video" }}
+				<video src="{{ html .Link }}" controls preload="metadata"></video>
+			{{- else if eq .Kind "audio" }}
+				<audio src="{{ html .Link }}" controls preload="metadata"></audio>
+			{{- else if eq .Kind "pdf" }}
+				<iframe src="{{ html .Link }}" title="{{ html .Name }}"></iframe>
+			{{- else if eq .Kind "markdown" }}
+				<div class="readme">
+					{{ .Content }}
+				</div>
+			{{- else if eq .Kind "text" }}
+				{{ .Content }}
+			{{- else }}
+				<p>No preview available for this file.</p>
+			{{- end }}
+			{{- if .Truncated }}
+				<p class="truncated">The file is too large, only its beginning is displayed.</p>
+			{{- end }}
 			</div>
 		</main>
 		<footer>
@@ -313,3 +880,82 @@ footer {
 		</footer>
 	</body>
 </html>`
+
+const shareTemplate = `<!DOCTYPE html>
+<html>
+	<head>
+		<title>{{ PathBase .Name }} | {{ .SiteName }}</title>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+{{ template "style" }}
+	</head>
+	<body>
+		<header>
+			<h1>{{ html (PathBase .Name) }}</h1>
+		</header>
+		<main class="share">
+			<form method="post">
+				<p>This link is protected by a password.</p>
+				{{- if .Error }}
+				<p class="error">{{ .Error }}</p>
+				{{- end }}
+				<input type="password" name="password" placeholder="Password" autofocus required>
+				<button type="submit">Open</button>
+			</form>
+		</main>
+		<footer>
+			Served by S3 Browser via <a rel="noopener noreferrer" href="https://caddyserver.com">Caddy</a>
+		</footer>
+	</body>
+</html>`
+
+const versionsTemplate = `<!DOCTYPE html>
+<html>
+	<head>
+		<title>{{ .Name }} (versions) | {{ .SiteName }}</title>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+{{ template "style" }}
+	</head>
+	<body>
+		<header>
+			<h1>
+				{{ range $_, $crumb := Breadcrumbs $.TemplateArgs }}
+					<a href="{{ html $crumb.Link }}">{{ html $crumb.Name }}</a> /
+				{{ end }}
+				{{ html .Name }}
+			</h1>
+		</header>
+		<main class="versions">
+			<table>
+				<thead>
+				<tr>
+					<th>Modified</th>
+					<th>Size</th>
+					<th class="hideable">Version</th>
+					<th></th>
+				</tr>
+				</thead>
+				<tbody>
+				{{- range .Versions }}
+				<tr{{ if .Deleted }} class="deleted"{{ end }}>
+					<td{{ if .Latest }} class="latest"{{ end }}><time datetime="{{ .HumanModTime "2006-01-02T15:04:05Z" }}">{{ .HumanModTime "01/02/2006 03:04:05 PM -07:00" }}</time></td>
+					{{- if .Deleted }}
+					<td><span class="name">deleted</span></td>
+					<td class="hideable">{{ .VersionID }}</td>
+					<td></td>
+					{{- else }}
+					<td>{{ .HumanSize }}</td>
+					<td class="hideable">{{ .VersionID }}</td>
+					<td><a href="{{ VersionLink $.Link .VersionID }}" download>Download</a></td>
+					{{- end }}
+				</tr>
+				{{- end }}
+				</tbody>
+			</table>
+		</main>
+		<footer>
+			Served by S3 Browser via <a rel="noopener noreferrer" href="https://caddyserver.com">Caddy</a>
+		</footer>
+	</body>
+</html>`
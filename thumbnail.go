@@ -0,0 +1,227 @@
+package s3browser
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/image/draw"
+
+	// Register the decoders used by image.Decode
+	_ "image/gif"
+
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	defaultThumbnailSize      = 256
+	maxThumbnailSize          = 1024
+	defaultThumbnailCacheSize = 100 << 20 // 100 MiB
+	defaultThumbnailMaxSource = 20 << 20  // 20 MiB
+	maxThumbnailPixels        = 50e6      // decoded images use 4 bytes per pixel or more
+)
+
+var errSourceTooLarge = errors.New("image too large for a thumbnail")
+
+// ThumbnailCache creates thumbnails of images stored in S3 and keeps them
+// in a directory on local disk. When the directory grows over `maxSize`
+// the least recently used thumbnails are removed.
+type ThumbnailCache struct {
+	lock          sync.Mutex
+	backend       Backend
+	dir           string
+	maxSize       int64
+	maxSourceSize int64
+	logger        *zap.Logger
+	jobs          chan struct{} // bounds the thumbnails created at once
+}
+
+func NewThumbnailCache(backend Backend, dir string, maxSize, maxSourceSize int64, l *zap.Logger) (*ThumbnailCache, error) {
+	if maxSize <= 0 {
+		maxSize = defaultThumbnailCacheSize
+	}
+	if maxSourceSize <= 0 {
+		maxSourceSize = defaultThumbnailMaxSource
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &ThumbnailCache{
+		backend:       backend,
+		dir:           dir,
+		maxSize:       maxSize,
+		maxSourceSize: maxSourceSize,
+		logger:        l,
+		jobs:          make(chan struct{}, runtime.NumCPU()),
+	}, nil
+}
+
+// isImage reports whether a thumbnail can be created for the file.
+func isImage(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+		return true
+	}
+	return false
+}
+
+// Get returns the thumbnail of `filePath`, at most `size` pixels wide and high.
+// `file` is used to invalidate thumbnails of modified images.
+func (tc *ThumbnailCache) Get(ctx context.Context, filePath string, file File, size int) ([]byte, error) {
+	if file.Bytes > tc.maxSourceSize {
+		return nil, errSourceTooLarge
+	}
+
+	cachePath := tc.cachePath(filePath, file, size)
+
+	tc.lock.Lock()
+	data, err := ioutil.ReadFile(cachePath)
+	if err == nil {
+		// Touch the file so eviction keeps recently used thumbnails
+		now := time.Now()
+		_ = os.Chtimes(cachePath, now, now)
+	}
+	tc.lock.Unlock()
+	if err == nil {
+		return data, nil
+	}
+
+	data, err = tc.create(ctx, filePath, size)
+	if err != nil {
+		return nil, err
+	}
+
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	if err := ioutil.WriteFile(cachePath, data, 0600); err != nil {
+		tc.logger.Warn("could not write thumbnail", zap.String("path", cachePath), zap.Error(err))
+	}
+	tc.evict()
+
+	return data, nil
+}
+
+func (tc *ThumbnailCache) cachePath(filePath string, file File, size int) string {
+	key := fmt.Sprintf("%s\x00%d\x00%d\x00%d", filePath, file.Bytes, file.Date.UnixNano(), size)
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(tc.dir, hex.EncodeToString(sum[:]))
+}
+
+func (tc *ThumbnailCache) create(ctx context.Context, filePath string, size int) ([]byte, error) {
+	select {
+	case tc.jobs <- struct{}{}:
+		defer func() { <-tc.jobs }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	reader, _, _, err := tc.backend.GetObject(ctx, filePath, "")
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(reader, tc.maxSourceSize))
+	if err != nil {
+		return nil, err
+	}
+	// A small file can declare huge dimensions, check them before decoding
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if int64(config.Width)*int64(config.Height) > maxThumbnailPixels {
+		return nil, errSourceTooLarge
+	}
+
+	src, format, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	dst := resize(src, size)
+
+	var buf bytes.Buffer
+	switch format {
+	case "png", "gif": // may be transparent
+		err = png.Encode(&buf, dst)
+	default:
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	}
+	return buf.Bytes(), err
+}
+
+// resize scales `src` down to fit in a `size`x`size` box, keeping the aspect ratio.
+// Images that already fit are never scaled up.
+func resize(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+
+	if w > h {
+		w, h = size, h*size/w
+	} else {
+		w, h = w*size/h, size
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+	return dst
+}
+
+// evict removes the least recently used thumbnails until the cache fits in `maxSize`.
+// Caller must hold the lock.
+func (tc *ThumbnailCache) evict() {
+	infos, err := ioutil.ReadDir(tc.dir)
+	if err != nil {
+		tc.logger.Warn("could not list thumbnails", zap.Error(err))
+		return
+	}
+
+	var total int64
+	for _, info := range infos {
+		total += info.Size()
+	}
+	if total <= tc.maxSize {
+		return
+	}
+
+	sort.Slice(infos, func(l, r int) bool {
+		return infos[l].ModTime().Before(infos[r].ModTime())
+	})
+	for _, info := range infos {
+		if total <= tc.maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(tc.dir, info.Name())); err != nil {
+			tc.logger.Warn("could not remove thumbnail", zap.String("name", info.Name()), zap.Error(err))
+			continue
+		}
+		total -= info.Size()
+	}
+}
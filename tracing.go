@@ -0,0 +1,47 @@
+package s3browser
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans.
+const tracerName = "github.com/techknowlogick/caddy-s3browser"
+
+// Span attributes
+const (
+	attrBucket    = attribute.Key("s3.bucket")
+	attrKey       = attribute.Key("s3.key")
+	attrVersionID = attribute.Key("s3.version_id")
+	attrBytes     = attribute.Key("s3browser.bytes")
+	attrPath      = attribute.Key("s3browser.path")
+	attrFormat    = attribute.Key("s3browser.format")
+	attrPrefix    = attribute.Key("s3browser.prefix")
+)
+
+// startSpan starts a span as a child of the span in `ctx`.
+//
+// Caddy's tracing handler does not register its tracer provider globally,
+// so the provider of the parent span is used, the spans then join the trace of the request.
+// Without a parent span (e.g. periodic refreshes), the global provider is used.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	provider := otel.GetTracerProvider()
+	if parent := trace.SpanFromContext(ctx); parent.SpanContext().IsValid() {
+		provider = parent.TracerProvider()
+	}
+	return provider.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends `span`, recording `err` if any.
+// It is deferred with the named error result of the caller.
+func endSpan(span trace.Span, err *error) {
+	if *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
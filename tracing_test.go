@@ -0,0 +1,74 @@
+package s3browser
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	b := newTestBrowser(t, &S3Browser{})
+
+	tests := []struct {
+		name   string
+		target string
+		span   string
+		attrs  []attribute.KeyValue
+	}{
+		{"listing", "/docs/?format=json", "s3browser.listing", []attribute.KeyValue{
+			attrPath.String("/docs"),
+			attrFormat.String(formatJSON),
+		}},
+		{"tree", "/docs/?recursive=true", "s3browser.listing", []attribute.KeyValue{
+			attrPath.String("/docs"),
+			attrFormat.String(formatTree),
+		}},
+		{"download", "/b.txt", "s3browser.download", []attribute.KeyValue{
+			attrPath.String("/b.txt"),
+			attrBytes.Int64(10),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := tracetest.NewInMemoryExporter()
+			provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+			defer provider.Shutdown(context.Background())
+
+			// Like Caddy's tracing handler, the provider is only known from the request span
+			ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+			r := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.target, nil).WithContext(ctx)
+			if _, err := serve(b, r); err != nil {
+				t.Fatal(err)
+			}
+			parent.End()
+
+			spans := exporter.GetSpans()
+			var found *tracetest.SpanStub
+			for i := range spans {
+				if spans[i].Name == tt.span {
+					found = &spans[i]
+				}
+			}
+			if found == nil {
+				t.Fatalf("no %s span in %d spans", tt.span, len(spans))
+			}
+			if found.Parent.SpanID() != parent.SpanContext().SpanID() {
+				t.Errorf("%s is not a child of the request span", tt.span)
+			}
+			if found.InstrumentationLibrary.Name != tracerName {
+				t.Errorf("instrumentation name: got %q", found.InstrumentationLibrary.Name)
+			}
+			got := attribute.NewSet(found.Attributes...)
+			for _, want := range tt.attrs {
+				if val, ok := got.Value(want.Key); !ok || val != want.Value {
+					t.Errorf("%s: got %v, want %v", want.Key, val.Emit(), want.Value.Emit())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package s3browser
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// recursiveRequested checks for `?recursive=true`.
+func recursiveRequested(r *http.Request) bool {
+	recursive, _ := strconv.ParseBool(r.URL.Query().Get("recursive"))
+	return recursive
+}
+
+// serveTree streams every entry below `dir` as NDJSON, one jsonEntry per line, up to `?depth=` levels.
+// Each directory is followed by its content, files before folders.
+// Only the S3FsCache is used, directories are fetched one at a time so refreshes are not blocked by slow clients.
+func (b *S3Browser) serveTree(w http.ResponseWriter, r *http.Request, dir Directory) error {
+	depth := 0 // no limit
+	if val := r.URL.Query().Get("depth"); val != "" {
+		var err error
+		if depth, err = strconv.Atoi(val); err != nil || depth <= 0 {
+			return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid depth: %q", val))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	w.Header().Set("Vary", "Accept")
+
+	baseURL := requestBaseURL(r)
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+
+	var walk func(dir Directory, level int) error
+	walk = func(dir Directory, level int) error {
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		for _, name := range dir.Filenames {
+			if err := enc.Encode(b.fileEntry(baseURL, dir.Path, name, dir.GetFile(name))); err != nil {
+				return err
+			}
+		}
+		for _, name := range dir.Folders {
+			if err := enc.Encode(dirEntry(baseURL, dir.Path, name)); err != nil {
+				return err
+			}
+			if depth > 0 && level >= depth {
+				continue
+			}
+			// Removed since the parent was fetched
+			sub, ok := b.s3Cache.GetDir(path.Join(dir.Path, name))
+			if !ok {
+				continue
+			}
+			if err := walk(b.filterDir(r, sub), level+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := walk(dir, 1); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
@@ -0,0 +1,47 @@
+package s3browser
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestTree(t *testing.T) {
+	b := newTestBrowser(t, &S3Browser{})
+
+	tests := []struct {
+		name   string
+		target string
+	}{
+		{"tree_root", "/?recursive=true"},
+		{"tree_depth", "/?recursive=true&depth=1"},
+		{"tree_subdir", "/docs/?recursive=1&depth=2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.target, nil)
+			w, err := serve(b, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson; charset=utf-8" {
+				t.Errorf("Content-Type: %q", ct)
+			}
+			checkGolden(t, tt.name, w.Body.Bytes())
+		})
+	}
+}
+
+func TestTreeInvalidDepth(t *testing.T) {
+	b := newTestBrowser(t, &S3Browser{})
+
+	for _, depth := range []string{"0", "-1", "all"} {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/?recursive=true&depth="+depth, nil)
+		_, err := serve(b, r)
+		if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusBadRequest {
+			t.Errorf("depth=%s: got %v, want a 400 error", depth, err)
+		}
+	}
+}
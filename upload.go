@@ -0,0 +1,393 @@
+package s3browser
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Values for upload_overwrite
+const (
+	overwriteDeny   = "deny"
+	overwriteAllow  = "allow"
+	overwriteRename = "rename"
+)
+
+// maxUploadParts is the maximum number of parts of an S3 multipart upload.
+const maxUploadParts = 10000
+
+var errUploadTooLarge = errors.New("file too large")
+
+type uploadedFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag"`
+}
+
+type uploadInitResponse struct {
+	Path     string `json:"path"`
+	UploadID string `json:"uploadId"`
+	PartSize int64  `json:"partSize"`
+}
+
+type uploadPart struct {
+	Part int    `json:"part"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag"`
+}
+
+type uploadTokenResponse struct {
+	CSRF string `json:"csrf"`
+}
+
+type uploadStatusResponse struct {
+	Path     string       `json:"path"`
+	UploadID string       `json:"uploadId"`
+	Parts    []uploadPart `json:"parts"`
+}
+
+// maxSizeReader fails with errUploadTooLarge once more than `n` bytes were read.
+type maxSizeReader struct {
+	r io.Reader
+	n int64 // remaining bytes, negative for no limit
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	if m.n < 0 {
+		return m.r.Read(p)
+	}
+	if int64(len(p)) > m.n+1 {
+		p = p[:m.n+1]
+	}
+	n, err := m.r.Read(p)
+	m.n -= int64(n)
+	if m.n < 0 {
+		return n, errUploadTooLarge
+	}
+	return n, err
+}
+
+// authorized checks the credentials of requests modifying the bucket.
+// When a secret is set, it must be sent as the basic auth password (the user name is ignored).
+// Otherwise the request must have been authenticated by Caddy, e.g. with basicauth or forward_auth.
+func authorized(r *http.Request, secret string) bool {
+	if secret != "" {
+		_, pwd, ok := r.BasicAuth()
+		return ok && subtle.ConstantTimeCompare([]byte(pwd), []byte(secret)) == 1
+	}
+	return requestUser(r) != ""
+}
+
+// requestUser returns the user authenticated by Caddy, if any.
+func requestUser(r *http.Request) string {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return ""
+	}
+	user, _ := repl.GetString("http.auth.user.id")
+	return user
+}
+
+// serveUpload handles the `?upload` requests:
+//   - GET <dir>?upload=login: ask for credentials, then go back to the listing
+//   - GET <dir>?upload=token: the CSRF token the other requests must send in X-CSRF-Token, for scripts
+//   - POST <dir>?upload: multipart/form-data upload of one or more files
+//   - POST <file>?upload=init&size=<bytes>: start a resumable upload
+//   - PUT <file>?upload=part&uploadId=<id>&part=<n>: upload part n (starting at 1)
+//   - GET <file>?upload=status&uploadId=<id>: list the parts already uploaded
+//   - POST <file>?upload=complete&uploadId=<id>: assemble the parts
+//   - POST <file>?upload=abort&uploadId=<id>: cancel the upload
+func (b *S3Browser) serveUpload(w http.ResponseWriter, r *http.Request) error {
+	if !authorized(r, b.UploadSecret) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="s3browser"`)
+		return caddyhttp.Error(http.StatusUnauthorized, nil)
+	}
+
+	fullPath := normalizePath(r.URL.Path)
+	query := r.URL.Query()
+	action := query.Get("upload")
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case action == "login" && r.Method == http.MethodGet:
+		http.Redirect(w, r, (&url.URL{Path: fullPath}).EscapedPath(), http.StatusSeeOther)
+		return nil
+	case action == "token" && r.Method == http.MethodGet:
+		// Other sites can't read the response
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		return b.writeJSON(w, uploadTokenResponse{CSRF: b.csrfToken(r)})
+	}
+	// Requests without a body are marked as JSON by scripts, a form can't send them cross-site
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err := b.checkCSRF(r, mediaType == "application/json"); err != nil {
+		return err
+	}
+
+	if action != "" && !b.allowed(r, permUpload, fullPath) {
+		return b.denied(r, fullPath)
+	}
+
+	// Resumable uploads are S3 multipart uploads
+	if action != "" && b.s3Client() == nil {
+		return caddyhttp.Error(http.StatusNotImplemented, fmt.Errorf("resumable uploads require the s3 backend"))
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodPost:
+		return b.uploadForm(w, r, fullPath)
+	case action == "init" && r.Method == http.MethodPost:
+		return b.uploadInit(w, r, fullPath)
+	case action == "part" && r.Method == http.MethodPut && uploadID != "":
+		return b.uploadPart(w, r, fullPath, uploadID)
+	case action == "status" && r.Method == http.MethodGet && uploadID != "":
+		return b.uploadStatus(w, r, fullPath, uploadID)
+	case action == "complete" && r.Method == http.MethodPost && uploadID != "":
+		return b.uploadComplete(w, r, fullPath, uploadID)
+	case action == "abort" && r.Method == http.MethodPost && uploadID != "":
+		client := b.s3Client()
+		return client.AbortMultipartUpload(r.Context(), fullPath, uploadID)
+	default:
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid upload request"))
+	}
+}
+
+// uploadTarget checks if a file named `name` can be uploaded in `dirPath` and returns its path.
+// Depending on upload_overwrite, an existing file is replaced, the new one is renamed or the upload is refused.
+func (b *S3Browser) uploadTarget(dirPath, name string) (string, error) {
+	if !validName(name) {
+		return "", caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid file name: %q", name))
+	}
+	if _, ok := b.s3Cache.GetDir(dirPath); !ok {
+		return "", caddyhttp.Error(http.StatusNotFound, fmt.Errorf("no such directory: %s", dirPath))
+	}
+
+	if !allowedExtension(b.UploadExtensions, name) {
+		return "", caddyhttp.Error(http.StatusForbidden, fmt.Errorf("file extension not allowed: %q", name))
+	}
+
+	filePath := path.Join(dirPath, name)
+	if _, ok := b.s3Cache.GetDir(filePath); ok {
+		return "", caddyhttp.Error(http.StatusConflict, fmt.Errorf("a directory exists: %s", filePath))
+	}
+	if _, ok := b.s3Cache.GetFile(filePath); !ok {
+		return filePath, nil
+	}
+
+	switch b.UploadOverwrite {
+	case overwriteAllow:
+		return filePath, nil
+	case overwriteRename:
+		ext := path.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for i := 1; ; i++ {
+			candidate := path.Join(dirPath, fmt.Sprintf("%s (%d)%s", base, i, ext))
+			_, fileExists := b.s3Cache.GetFile(candidate)
+			_, dirExists := b.s3Cache.GetDir(candidate)
+			if !fileExists && !dirExists {
+				return candidate, nil
+			}
+		}
+	default:
+		return "", caddyhttp.Error(http.StatusConflict, fmt.Errorf("file exists: %s", filePath))
+	}
+}
+
+// allowedExtension reports whether `name` ends with one of `extensions`, all names are allowed without extensions.
+func allowedExtension(extensions []string, name string) bool {
+	if len(extensions) == 0 {
+		return true
+	}
+	for _, ext := range extensions {
+		if strings.HasSuffix(strings.ToLower(name), "."+strings.ToLower(strings.TrimPrefix(ext, "."))) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *S3Browser) checkUploadSize(size int64) error {
+	if b.UploadMaxSize > 0 && size > b.UploadMaxSize {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge, errUploadTooLarge)
+	}
+	return nil
+}
+
+// uploadForm streams each file of the form to S3, nothing is buffered besides one multipart part.
+func (b *S3Browser) uploadForm(w http.ResponseWriter, r *http.Request, dirPath string) error {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	uploaded := []uploadedFile{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+		if part.FileName() == "" {
+			continue // not a file
+		}
+
+		filePath, err := b.uploadTarget(dirPath, part.FileName())
+		if err != nil {
+			return err
+		}
+		if !b.allowed(r, permUpload, filePath) {
+			return b.denied(r, filePath)
+		}
+
+		limit := int64(-1)
+		if b.UploadMaxSize > 0 {
+			limit = b.UploadMaxSize
+		}
+		contentType := part.Header.Get("Content-Type")
+		if contentType == "" || contentType == "application/octet-stream" {
+			contentType = mimeType(filePath)
+		}
+
+		obj, err := b.store.PutObject(r.Context(), filePath, &maxSizeReader{r: part, n: limit}, -1, contentType)
+		if errors.Is(err, errUploadTooLarge) {
+			return caddyhttp.Error(http.StatusRequestEntityTooLarge, err)
+		}
+		if err != nil {
+			return err
+		}
+
+		b.s3Cache.AddObject(obj)
+		b.log.Info("upload",
+			zap.String("path", filePath),
+			zap.Int64("size", obj.Size),
+			zap.String("user", requestUser(r)))
+		uploaded = append(uploaded, uploadedFile{Path: filePath, Size: obj.Size, ETag: obj.ETag})
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return b.writeJSON(w, uploaded)
+}
+
+func (b *S3Browser) uploadInit(w http.ResponseWriter, r *http.Request, fullPath string) error {
+	size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+	if err != nil || size < 0 {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid size"))
+	}
+	if err := b.checkUploadSize(size); err != nil {
+		return err
+	}
+	if size > uploadPartSize*maxUploadParts {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge, errUploadTooLarge)
+	}
+
+	dirPath, name := path.Split(fullPath)
+	filePath, err := b.uploadTarget(normalizePath(dirPath), name)
+	if err != nil {
+		return err
+	}
+
+	client := b.s3Client()
+	uploadID, err := client.NewMultipartUpload(r.Context(), filePath, mimeType(filePath))
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return b.writeJSON(w, uploadInitResponse{
+		Path:     filePath,
+		UploadID: uploadID,
+		PartSize: uploadPartSize,
+	})
+}
+
+func (b *S3Browser) uploadPart(w http.ResponseWriter, r *http.Request, filePath, uploadID string) error {
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("part"))
+	if err != nil || partNumber < 1 || partNumber > maxUploadParts {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid part number"))
+	}
+	if r.ContentLength < 0 {
+		return caddyhttp.Error(http.StatusLengthRequired, nil)
+	}
+	if r.ContentLength > uploadPartSize {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge, fmt.Errorf("part larger than %d bytes", uploadPartSize))
+	}
+
+	client := b.s3Client()
+	part, err := client.PutObjectPart(r.Context(), filePath, uploadID, partNumber, r.Body, r.ContentLength)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return b.writeJSON(w, uploadPart{Part: part.PartNumber, Size: part.Size, ETag: part.ETag})
+}
+
+func (b *S3Browser) uploadStatus(w http.ResponseWriter, r *http.Request, filePath, uploadID string) error {
+	client := b.s3Client()
+	parts, err := client.ListObjectParts(r.Context(), filePath, uploadID)
+	if err != nil {
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+
+	status := uploadStatusResponse{Path: filePath, UploadID: uploadID, Parts: []uploadPart{}}
+	for _, part := range parts {
+		status.Parts = append(status.Parts, uploadPart{Part: part.PartNumber, Size: part.Size, ETag: part.ETag})
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return b.writeJSON(w, status)
+}
+
+func (b *S3Browser) uploadComplete(w http.ResponseWriter, r *http.Request, filePath, uploadID string) error {
+	client := b.s3Client()
+	parts, err := client.ListObjectParts(r.Context(), filePath, uploadID)
+	if err != nil {
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+	sort.Slice(parts, func(l, r int) bool {
+		return parts[l].PartNumber < parts[r].PartNumber
+	})
+
+	var size int64
+	for _, part := range parts {
+		size += part.Size
+	}
+	if err := b.checkUploadSize(size); err != nil {
+		_ = client.AbortMultipartUpload(r.Context(), filePath, uploadID)
+		return err
+	}
+
+	// The file may have been created since the upload started
+	if _, exists := b.s3Cache.GetFile(filePath); exists && b.UploadOverwrite != overwriteAllow {
+		return caddyhttp.Error(http.StatusConflict, fmt.Errorf("file exists: %s", filePath))
+	}
+
+	obj, err := client.CompleteMultipartUpload(r.Context(), filePath, uploadID, parts)
+	if err != nil {
+		return err
+	}
+
+	b.s3Cache.AddObject(obj)
+	b.log.Info("upload",
+		zap.String("path", filePath),
+		zap.Int64("size", obj.Size),
+		zap.Int("parts", len(parts)),
+		zap.String("user", requestUser(r)))
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return b.writeJSON(w, uploadedFile{Path: filePath, Size: obj.Size, ETag: obj.ETag})
+}
@@ -0,0 +1,149 @@
+package s3browser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+const testUploadSecret = "upload secret"
+
+// uploadToken gets the CSRF token of the uploads like a script would.
+func uploadToken(t *testing.T, b *S3Browser) string {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/docs/?upload=token", nil)
+	r.SetBasicAuth("", testUploadSecret)
+	w, err := serve(b, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp uploadTokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.CSRF
+}
+
+// newUploadRequest returns a form upload of a file named `name` to /docs/.
+func newUploadRequest(t *testing.T, name string, content string) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("files", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(content))
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/docs/?upload", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+func TestUploadForm(t *testing.T) {
+	b := newTestBrowser(t, &S3Browser{
+		Upload:           true,
+		UploadSecret:     testUploadSecret,
+		UploadMaxSize:    10,
+		UploadExtensions: []string{"txt", ".md"},
+	})
+	token := uploadToken(t, b)
+	if token == "" {
+		t.Fatal("no CSRF token")
+	}
+
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		password string
+		token    string
+		origin   string
+		status   int // 0 for success
+	}{
+		{"no credentials", "a1.txt", "new", "", token, "", http.StatusUnauthorized},
+		{"wrong credentials", "a2.txt", "new", "wrong", token, "", http.StatusUnauthorized},
+		{"no CSRF token", "a3.txt", "new", testUploadSecret, "", "", http.StatusForbidden},
+		{"wrong CSRF token", "a4.txt", "new", testUploadSecret, "0123", "", http.StatusForbidden},
+		{"other origin", "a5.txt", "new", testUploadSecret, token, "https://evil.example", http.StatusForbidden},
+		{"too large", "a6.txt", "01234567890", testUploadSecret, token, "", http.StatusRequestEntityTooLarge},
+		{"extension", "a7.exe", "new", testUploadSecret, token, "", http.StatusForbidden},
+		{"no extension", "txt", "new", testUploadSecret, token, "", http.StatusForbidden},
+		{"existing file", "guide.txt", "new", testUploadSecret, token, "", http.StatusConflict},
+		{"invalid name", "..", "new", testUploadSecret, token, "", http.StatusBadRequest},
+		{"upload", "b1.txt", "0123456789", testUploadSecret, token, "", 0},
+		{"same origin", "b2.TXT", "new", testUploadSecret, token, "http://example.com", 0},
+		{"other extension", "b3.md", "new", testUploadSecret, token, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newUploadRequest(t, tt.file, tt.content)
+			if tt.password != "" {
+				r.SetBasicAuth("", tt.password)
+			}
+			if tt.token != "" {
+				r.Header.Set("X-CSRF-Token", tt.token)
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			_, err := serve(b, r)
+
+			_, statErr := b.store.StatObject(context.Background(), "/docs/"+tt.file)
+			if tt.status == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if statErr != nil {
+					t.Errorf("not uploaded: %v", statErr)
+				}
+				if _, ok := b.s3Cache.GetFile("/docs/" + tt.file); !ok {
+					t.Error("not added to the cache")
+				}
+				return
+			}
+			if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != tt.status {
+				t.Errorf("got %v, want a %d error", err, tt.status)
+			}
+			if statErr == nil && tt.file != "guide.txt" {
+				t.Error("uploaded")
+			}
+		})
+	}
+	if data, _ := b.store.(*MemoryBackend).objects["docs/guide.txt"]; string(data.data) != "read me first" {
+		t.Errorf("an existing file was replaced by %q", data.data)
+	}
+}
+
+// The form of the listing only gets the token once logged in
+func TestUploadListingToken(t *testing.T) {
+	b := newTestBrowser(t, &S3Browser{Upload: true, UploadSecret: testUploadSecret})
+	token := uploadToken(t, b)
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/docs/", nil)
+	w, err := serve(b, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(w.Body.Bytes(), []byte(token)) {
+		t.Error("anonymous listing with the upload token")
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "http://example.com/docs/", nil)
+	r.SetBasicAuth("", testUploadSecret)
+	if w, err = serve(b, r); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte(token)) {
+		t.Error("no upload token in the listing")
+	}
+}
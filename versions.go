@@ -0,0 +1,180 @@
+package s3browser
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/minio/minio-go/v7"
+)
+
+// VersionsArgs are the arguments of the versions template.
+type VersionsArgs struct {
+	TemplateArgs
+	Name     string
+	Link     string // URL of the file
+	Versions []FileVersion
+}
+
+// FileVersion is a version of a file, most recent first.
+type FileVersion struct {
+	File
+	VersionID string
+	Latest    bool
+	Deleted   bool // delete marker, there is no content
+}
+
+// DeletedFile is a file whose latest version is a delete marker, see `?deleted`.
+type DeletedFile struct {
+	Name string
+	Date time.Time // of the deletion
+}
+
+type jsonVersions struct {
+	Path     string        `json:"path"`
+	Versions []jsonVersion `json:"versions"`
+}
+
+type jsonVersion struct {
+	VersionID string    `json:"version_id"`
+	Size      *int64    `json:"size,omitempty"`
+	Mtime     time.Time `json:"mtime"`
+	ETag      string    `json:"etag,omitempty"`
+	Latest    bool      `json:"latest"`
+	Deleted   bool      `json:"deleted"`
+	URL       string    `json:"url,omitempty"` // none for delete markers
+}
+
+// fileVersions lists the versions of the file, most recent first.
+func (b *S3Browser) fileVersions(ctx context.Context, filePath string) ([]FileVersion, error) {
+	client := b.s3Client()
+	key := strings.TrimLeft(filePath, "/")
+	versions := []FileVersion{}
+	err := client.ForEachObjectVersion(ctx, key, false, func(v minio.ObjectInfo) {
+		// The prefix also matches longer keys
+		if v.Key != key {
+			return
+		}
+		versions = append(versions, FileVersion{
+			File:      File{Bytes: v.Size, Date: v.LastModified, ETag: v.ETag},
+			VersionID: v.VersionID,
+			Latest:    v.IsLatest,
+			Deleted:   v.IsDeleteMarker,
+		})
+	})
+	return versions, err
+}
+
+// versionedFile tells if `filePath` is a file whose versions can be listed: a cached file,
+// or a file of a cached directory which is not cached because it was deleted.
+func (b *S3Browser) versionedFile(filePath string) bool {
+	if _, ok := b.s3Cache.GetFile(filePath); ok {
+		return true
+	}
+	if filePath == "/" || strings.HasSuffix(filePath, "/") {
+		return false
+	}
+	if _, ok := b.s3Cache.GetDir(filePath); ok {
+		return false
+	}
+	_, ok := b.s3Cache.GetDir(path.Dir(filePath))
+	return ok
+}
+
+// deletedFiles lists the files of `dir` whose latest version is a delete marker, the requester can list.
+func (b *S3Browser) deletedFiles(r *http.Request, dir Directory) ([]DeletedFile, error) {
+	client := b.s3Client()
+	prefix := strings.TrimLeft(dir.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	deleted := []DeletedFile{}
+	err := client.ForEachObjectVersion(r.Context(), prefix, false, func(v minio.ObjectInfo) {
+		if !v.IsLatest || !v.IsDeleteMarker {
+			return
+		}
+		p := "/" + v.Key
+		if b.s3Cache.Hidden(p) || !b.allowed(r, permList, p) {
+			return
+		}
+		deleted = append(deleted, DeletedFile{Name: path.Base(p), Date: v.LastModified})
+	})
+	return deleted, err
+}
+
+// serveVersions handles `GET <file>?versions`, listing the versions of the file
+// as HTML, or as JSON like the listing (see wantsJSON). The file may be deleted.
+func (b *S3Browser) serveVersions(w http.ResponseWriter, r *http.Request, filePath string) (err error) {
+	ctx, span := startSpan(r.Context(), "s3browser.versions", attrPath.String(filePath))
+	defer endSpan(span, &err)
+
+	if b.s3Cache.Hidden(filePath) || !b.versionedFile(filePath) || !b.allowed(r, permList, filePath) {
+		return caddyhttp.Error(http.StatusNotFound, nil)
+	}
+	versions, err := b.fileVersions(ctx, filePath)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return caddyhttp.Error(http.StatusNotFound, nil)
+	}
+
+	w.Header().Set("Vary", "Accept")
+	if wantsJSON(r) {
+		baseURL := requestBaseURL(r)
+		out := jsonVersions{Path: filePath, Versions: []jsonVersion{}}
+		for _, v := range versions {
+			v := v
+			entry := jsonVersion{VersionID: v.VersionID, Mtime: v.Date, Latest: v.Latest, Deleted: v.Deleted}
+			if !v.Deleted {
+				entry.Size = &v.Bytes
+				entry.ETag = v.ETag
+				entry.URL = baseURL + versionLink(filePath, v.VersionID)
+			}
+			out.Versions = append(out.Versions, entry)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		return b.writeJSON(w, out)
+	}
+
+	dirPath, name := path.Split(filePath)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return b.template.ExecuteTemplate(w, "versions", VersionsArgs{
+		TemplateArgs: TemplateArgs{
+			SiteName: b.SiteName,
+			Dir:      Directory{Path: normalizePath(dirPath)},
+		},
+		Name:     name,
+		Link:     filePath,
+		Versions: versions,
+	})
+}
+
+// versionLink returns the escaped URL path downloading a version of the file.
+func versionLink(filePath string, versionID string) string {
+	return (&url.URL{Path: filePath, RawQuery: url.Values{"versionId": {versionID}}.Encode()}).RequestURI()
+}
+
+// serveVersion handles `GET <file>?versionId=`, downloading a previous version like the current one.
+func (b *S3Browser) serveVersion(w http.ResponseWriter, r *http.Request, filePath string, versionID string) error {
+	if b.s3Cache.Hidden(filePath) || !b.versionedFile(filePath) {
+		return caddyhttp.Error(http.StatusNotFound, nil)
+	}
+	if !b.allowed(r, permDownload, filePath) {
+		return b.denied(r, filePath)
+	}
+	versions, err := b.fileVersions(r.Context(), filePath)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if v.VersionID == versionID && !v.Deleted {
+			return b.serveDownload(w, r, filePath, v.Bytes)
+		}
+	}
+	return caddyhttp.Error(http.StatusNotFound, nil)
+}
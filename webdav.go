@@ -0,0 +1,411 @@
+package s3browser
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"golang.org/x/net/webdav"
+)
+
+// Interface guards
+var (
+	_ webdav.FileSystem   = (*davFS)(nil)
+	_ webdav.File         = (*davFile)(nil)
+	_ webdav.File         = (*davUpload)(nil)
+	_ io.ReaderFrom       = (*davUpload)(nil)
+	_ webdav.ETager       = davFileInfo{}
+	_ webdav.ContentTyper = davFileInfo{}
+)
+
+// davReadMethods are the WebDAV methods available in read-only mode,
+// GET and HEAD are served like any other request.
+var davReadMethods = []string{http.MethodOptions, http.MethodGet, http.MethodHead, "PROPFIND"}
+
+// davFS exposes the S3FsCache tree as a webdav.FileSystem.
+// Only the metadata is needed by PROPFIND, so nothing is read from S3.
+// When writable, changes are made in S3 and patched into the cache right away,
+// new files are checked against upload_max_size and upload_extensions like the form uploads.
+type davFS struct {
+	cache      *S3FsCache
+	s3         *S3Client // nil unless writable
+	writable   bool
+	acl        *accessControl
+	maxSize    int64 // negative for no limit
+	extensions []string
+}
+
+type davFileInfo struct {
+	name string
+	dir  bool
+	file File
+}
+
+// davFile is a directory or a file opened for reading its metadata.
+type davFile struct {
+	fs      *davFS
+	path    string
+	info    davFileInfo
+	subject subject // who opened the file, for filtering Readdir
+	dirRead bool    // Readdir was already called
+}
+
+// davUpload is a file opened for writing, the content is streamed to S3.
+type davUpload struct {
+	ctx     context.Context // of the request, cancels the upload
+	fs      *davFS
+	path    string
+	written int64
+	done    bool           // the object was uploaded or copied
+	pipe    *io.PipeWriter // set once Write was called
+	result  chan error     // result of the upload fed by `pipe`
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func newDAVHandler(cache *S3FsCache, client *S3Client, writable bool, acl *accessControl, maxSize int64, extensions []string, logger *zap.Logger) *webdav.Handler {
+	if maxSize <= 0 {
+		maxSize = -1
+	}
+	return &webdav.Handler{
+		FileSystem: &davFS{cache: cache, s3: client, writable: writable, acl: acl, maxSize: maxSize, extensions: extensions},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				logger.Debug("webdav", zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.Error(err))
+			}
+		},
+	}
+}
+
+func (b *S3Browser) serveWebDAV(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodOptions:
+		if b.WebDAVWritable {
+			b.davHandler.ServeHTTP(w, r)
+			return nil
+		}
+		w.Header().Set("DAV", "1")
+		w.Header().Set("Allow", strings.Join(davReadMethods, ", "))
+		w.Header().Set("MS-Author-Via", "DAV")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case "PROPFIND":
+		// Walking the whole bucket at once is not supported (RFC 4918, section 9.1)
+		if depth := r.Header.Get("Depth"); depth != "0" && depth != "1" {
+			w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			_, err := io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>`+
+				`<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`)
+			return err
+		}
+		b.davHandler.ServeHTTP(w, r)
+		return nil
+	default:
+		if !b.WebDAVWritable {
+			w.Header().Set("Allow", strings.Join(davReadMethods, ", "))
+			return caddyhttp.Error(http.StatusMethodNotAllowed, nil)
+		}
+		// Changes are authenticated like the management actions
+		if err := checkOrigin(r); err != nil {
+			return err
+		}
+		if !authorized(r, b.ManageSecret) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="s3browser"`)
+			return caddyhttp.Error(http.StatusUnauthorized, nil)
+		}
+		// Checked again while streaming, webdav.Handler would answer 405
+		if r.Method == http.MethodPut {
+			if err := b.checkUploadSize(r.ContentLength); err != nil {
+				return err
+			}
+		}
+		b.davHandler.ServeHTTP(w, r)
+		return nil
+	}
+}
+
+// newDirInfo uses the most recent file of the directory as its modification date.
+func newDirInfo(name string, dir Directory) davFileInfo {
+	info := davFileInfo{name: name, dir: true}
+	for _, file := range dir.files {
+		if file.Date.After(info.file.Date) {
+			info.file.Date = file.Date
+		}
+	}
+	return info
+}
+
+// allowed checks the permission of the requester, the subject is stored in the context by ServeHTTP.
+func (fs *davFS) allowed(ctx context.Context, perm string, name string) bool {
+	s, _ := ctx.Value(subjectCtxKey{}).(subject)
+	return fs.acl.allowed(s, perm, name)
+}
+
+// allowFunc checks the permissions of the requester of `ctx`, see removePath and renamePath.
+func (fs *davFS) allowFunc(ctx context.Context) allowFunc {
+	return func(perm string, p string) bool {
+		return fs.allowed(ctx, perm, p)
+	}
+}
+
+func (fs *davFS) stat(ctx context.Context, name string) (davFileInfo, bool) {
+	name = normalizePath(name)
+	if !fs.allowed(ctx, permList, name) {
+		return davFileInfo{}, false
+	}
+	if dir, ok := fs.cache.GetDir(name); ok {
+		return newDirInfo(path.Base(name), dir), true
+	}
+	if file, ok := fs.cache.GetFile(name); ok {
+		return davFileInfo{name: path.Base(name), file: file}, true
+	}
+	return davFileInfo{}, false
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, ok := fs.stat(ctx, name)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return info, nil
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = normalizePath(name)
+	// Objects can only be replaced, not modified
+	if flag&os.O_APPEND != 0 {
+		return nil, os.ErrPermission
+	}
+	// PROPPATCH opens the file O_RDWR without writing to it, only PUT and COPY create or truncate it
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		if !fs.writable || !fs.allowed(ctx, permUpload, name) || !allowedExtension(fs.extensions, name) {
+			return nil, os.ErrPermission
+		}
+		if _, ok := fs.cache.GetDir(name); ok {
+			return nil, os.ErrExist
+		}
+		if _, ok := fs.cache.GetDir(path.Dir(name)); !ok {
+			return nil, os.ErrNotExist
+		}
+		return &davUpload{ctx: ctx, fs: fs, path: name}, nil
+	}
+
+	info, ok := fs.stat(ctx, name)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	s, _ := ctx.Value(subjectCtxKey{}).(subject)
+	return &davFile{fs: fs, path: name, info: info, subject: s}, nil
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if !fs.writable || !fs.allowed(ctx, permUpload, name) {
+		return os.ErrPermission
+	}
+	return makeDir(ctx, fs.cache, *fs.s3, name)
+}
+
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	if !fs.writable || !fs.allowed(ctx, permDelete, name) {
+		return os.ErrPermission
+	}
+	err := removePath(ctx, fs.cache, *fs.s3, fs.allowFunc(ctx), name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // like os.RemoveAll
+	}
+	return err
+}
+
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	if !fs.writable || !fs.allowed(ctx, permDelete, oldName) || !fs.allowed(ctx, permUpload, newName) {
+		return os.ErrPermission
+	}
+	if _, ok := fs.cache.GetFile(normalizePath(oldName)); ok && !allowedExtension(fs.extensions, newName) {
+		return os.ErrPermission
+	}
+	return renamePath(ctx, fs.cache, *fs.s3, fs.allowFunc(ctx), oldName, newName)
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.info.dir {
+		return nil, os.ErrInvalid
+	}
+	dir, ok := f.fs.cache.GetDir(f.path)
+	if !ok || f.dirRead {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	f.dirRead = true
+	dir = f.fs.acl.filterDir(f.subject, dir)
+
+	infos := make([]os.FileInfo, 0, len(dir.Folders)+len(dir.Filenames))
+	for _, name := range dir.Folders {
+		subDir, _ := f.fs.cache.GetDir(path.Join(dir.Path, name))
+		infos = append(infos, newDirInfo(name, subDir))
+	}
+	for _, name := range dir.Filenames {
+		infos = append(infos, davFileInfo{name: name, file: dir.GetFile(name)})
+	}
+	return infos, nil
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// The content is served by ServeHTTP, webdav.Handler only needs the metadata.
+func (f *davFile) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *davFile) Close() error {
+	return nil
+}
+
+func (fi davFileInfo) Name() string       { return fi.name }
+func (fi davFileInfo) Size() int64        { return fi.file.Bytes }
+func (fi davFileInfo) ModTime() time.Time { return fi.file.Date }
+func (fi davFileInfo) IsDir() bool        { return fi.dir }
+func (fi davFileInfo) Sys() interface{}   { return nil }
+
+func (fi davFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (fi davFileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.file.ETag == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + fi.file.ETag + `"`, nil
+}
+
+func (fi davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.dir {
+		return "", webdav.ErrNotImplemented
+	}
+	return mimeType(fi.name), nil
+}
+
+// ReadFrom is used by io.Copy for both PUT and COPY.
+// When copying from another file of the bucket, the copy is made server-side.
+func (f *davUpload) ReadFrom(r io.Reader) (int64, error) {
+	if f.done || f.pipe != nil {
+		return io.Copy(struct{ io.Writer }{f}, r)
+	}
+	f.done = true
+
+	if src, ok := r.(*davFile); ok && !src.info.dir {
+		// Opening the source only required permList
+		if !f.fs.allowed(f.ctx, permDownload, src.path) {
+			return 0, os.ErrPermission
+		}
+		if f.fs.maxSize >= 0 && src.info.file.Bytes > f.fs.maxSize {
+			return 0, errUploadTooLarge
+		}
+		obj, err := f.fs.s3.CopyObject(f.ctx, src.path, f.path)
+		if err != nil {
+			return 0, err
+		}
+		f.fs.cache.AddObject(obj)
+		f.written = obj.Size
+		return obj.Size, nil
+	}
+
+	counter := &countingReader{r: r}
+	err := f.upload(counter)
+	f.written = counter.n
+	return counter.n, err
+}
+
+func (f *davUpload) Write(p []byte) (int, error) {
+	if f.pipe == nil {
+		if f.done {
+			return 0, os.ErrClosed
+		}
+		f.done = true
+
+		pr, pw := io.Pipe()
+		f.pipe = pw
+		f.result = make(chan error, 1)
+		go func() {
+			err := f.upload(pr)
+			pr.CloseWithError(err)
+			f.result <- err
+		}()
+	}
+
+	n, err := f.pipe.Write(p)
+	f.written += int64(n)
+	return n, err
+}
+
+func (f *davUpload) upload(r io.Reader) error {
+	obj, err := f.fs.s3.PutObject(f.ctx, f.path, &maxSizeReader{r: r, n: f.fs.maxSize}, -1, mimeType(f.path))
+	if err != nil {
+		return err
+	}
+	f.fs.cache.AddObject(obj)
+	return nil
+}
+
+func (f *davUpload) Close() error {
+	if f.pipe != nil {
+		f.pipe.Close()
+		err := <-f.result
+		f.pipe = nil
+		return err
+	}
+	if !f.done {
+		// Nothing was written, create an empty file
+		_, err := f.ReadFrom(bytes.NewReader(nil))
+		return err
+	}
+	return nil
+}
+
+func (f *davUpload) Stat() (os.FileInfo, error) {
+	return davFileInfo{name: path.Base(f.path), file: File{Bytes: f.written, Date: time.Now()}}, nil
+}
+
+func (f *davUpload) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f *davUpload) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *davUpload) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
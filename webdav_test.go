@@ -0,0 +1,125 @@
+package s3browser
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+const testManageSecret = "s3cret"
+
+func newDAVRequest(method string, target string, body string) *http.Request {
+	r := httptest.NewRequest(method, "http://example.com"+target, strings.NewReader(body))
+	r.SetBasicAuth("admin", testManageSecret)
+	return r
+}
+
+// Windows sends a PROPPATCH after each upload to set the dates
+func TestWebDAVPropPatch(t *testing.T) {
+	b, f := newTestS3Browser(t, &S3Browser{WebDAV: true, WebDAVWritable: true, ManageSecret: testManageSecret})
+
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:schemas-microsoft-com:">
+	<D:set><D:prop><Z:Win32LastModifiedTime>Fri, 01 Mar 2024 12:00:00 GMT</Z:Win32LastModifiedTime></D:prop></D:set>
+</D:propertyupdate>`
+	w, err := serve(b, newDAVRequest("PROPPATCH", "/b.txt", body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusMultiStatus {
+		t.Errorf("status: got %d, want 207", w.Code)
+	}
+	if data, _ := f.object("b.txt"); string(data) != "0123456789" {
+		t.Errorf("the object was changed to %q", data)
+	}
+	if file, _ := b.s3Cache.GetFile("/b.txt"); file.Bytes != 10 {
+		t.Errorf("the cached file has %d bytes", file.Bytes)
+	}
+}
+
+func TestWebDAVPut(t *testing.T) {
+	b, f := newTestS3Browser(t, &S3Browser{WebDAV: true, WebDAVWritable: true, ManageSecret: testManageSecret})
+
+	r := httptest.NewRequest(http.MethodPut, "http://example.com/docs/new.txt", strings.NewReader("new"))
+	_, err := serve(b, r)
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without credentials: got %v, want a 401 error", err)
+	}
+	if _, ok := f.object("docs/new.txt"); ok {
+		t.Fatal("uploaded without credentials")
+	}
+
+	w, err := serve(b, newDAVRequest(http.MethodPut, "/docs/new.txt", "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusCreated {
+		t.Errorf("status: got %d, want 201", w.Code)
+	}
+	if data, _ := f.object("docs/new.txt"); string(data) != "new" {
+		t.Errorf("uploaded %q", data)
+	}
+	if _, ok := b.s3Cache.GetFile("/docs/new.txt"); !ok {
+		t.Error("the new file is not cached")
+	}
+}
+
+// The limits of the form uploads apply to WebDAV too
+func TestWebDAVUploadLimits(t *testing.T) {
+	b, f := newTestS3Browser(t, &S3Browser{
+		WebDAV:           true,
+		WebDAVWritable:   true,
+		ManageSecret:     testManageSecret,
+		UploadMaxSize:    5,
+		UploadExtensions: []string{"txt"},
+	})
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		body        string
+		destination string
+		origin      string
+		chunked     bool
+		key         string // the object written on success
+		ok          bool
+	}{
+		{"extension", http.MethodPut, "/docs/new.exe", "new", "", "", false, "docs/new.exe", false},
+		{"too large", http.MethodPut, "/docs/large.txt", "012345", "", "", false, "docs/large.txt", false},
+		{"too large without length", http.MethodPut, "/docs/chunked.txt", "012345", "", "", true, "docs/chunked.txt", false},
+		{"other origin", http.MethodPut, "/docs/origin.txt", "new", "", "https://evil.example", false, "docs/origin.txt", false},
+		{"copy too large", "COPY", "/b.txt", "", "/docs/b.txt", "", false, "docs/b.txt", false},
+		{"copy to another extension", "COPY", "/a.txt", "", "/docs/a.exe", "", false, "docs/a.exe", false},
+		{"move to another extension", "MOVE", "/a.txt", "", "/a.exe", "", false, "a.exe", false},
+		{"upload", http.MethodPut, "/docs/new.txt", "01234", "", "", true, "docs/new.txt", true},
+		{"copy", "COPY", "/a.txt", "", "/docs/a.txt", "", false, "docs/a.txt", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newDAVRequest(tt.method, tt.target, tt.body)
+			if tt.destination != "" {
+				r.Header.Set("Destination", "http://example.com"+tt.destination)
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+			w, err := serve(b, r)
+			if ok := err == nil && w.Code < 400; ok != tt.ok {
+				t.Errorf("got %v, %d", err, w.Code)
+			}
+			if _, ok := f.object(tt.key); ok != tt.ok {
+				t.Errorf("%s written: %v, want %v", tt.key, ok, tt.ok)
+			}
+		})
+	}
+	if _, ok := f.object("a.txt"); !ok {
+		t.Error("a.txt was moved")
+	}
+}